@@ -20,18 +20,386 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-type AddonStatus string
 type CAddonStatus string
 
 const (
 	CAddonStatusSuccess CAddonStatus = "Success"
 	CAddonStatusFailure CAddonStatus = "Failed"
 	CAddonStatusPending CAddonStatus = "Pending"
+	// CAddonStatusSuspended is reported while spec.suspend is set.
+	CAddonStatusSuspended CAddonStatus = "Suspended"
+)
+
+type AddonPlanAction string
+
+const (
+	AddonPlanActionNone      AddonPlanAction = "None"
+	AddonPlanActionInstall   AddonPlanAction = "Install"
+	AddonPlanActionUpgrade   AddonPlanAction = "Upgrade"
+	AddonPlanActionUninstall AddonPlanAction = "Uninstall"
+)
+
+// ConflictPolicy decides what kcm does when server-side apply reports that
+// fields of an addon object are owned by another field manager.
+// +kubebuilder:validation:Enum=Force;Fail;Skip
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyForce takes the fields over from the other managers.
+	ConflictPolicyForce ConflictPolicy = "Force"
+	// ConflictPolicyFail fails the addon, leaving the object untouched.
+	ConflictPolicyFail ConflictPolicy = "Fail"
+	// ConflictPolicySkip leaves the fields owned by the managers listed in
+	// skipManagers alone and takes over the remaining ones.
+	ConflictPolicySkip ConflictPolicy = "Skip"
+)
+
+// DeletionPolicy decides what happens to the objects of an addon when its
+// ClusterAddon is deleted.
+// +kubebuilder:validation:Enum=Delete;Orphan;RetainCRDs
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete uninstalls the addon.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyOrphan leaves every object of the addon in place.
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+	// DeletionPolicyRetainCRDs uninstalls the addon but keeps its
+	// CustomResourceDefinitions, and so the custom resources stored in them.
+	DeletionPolicyRetainCRDs DeletionPolicy = "RetainCRDs"
 )
 
 type Addon struct {
 	Name    string  `json:"name"`
 	Version *string `json:"version,omitempty"`
+
+	// Suspended stops kcm from installing, upgrading or uninstalling this
+	// addon until it is unset again.
+	// +optional
+	Suspended bool `json:"suspended,omitempty"`
+
+	// ImageRewrite is applied to the images of this addon before the
+	// rules of spec.imageRewrite.
+	// +optional
+	ImageRewrite *ImageRewrite `json:"imageRewrite,omitempty"`
+
+	// Labels and Annotations are added to every object of this addon, on
+	// top of those of spec.labels and spec.annotations.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// ConflictPolicy applies when objects of this addon have fields owned
+	// by other field managers, it defaults to Force.
+	// +optional
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+
+	// SkipManagers are the field managers whose fields are left alone with
+	// the Skip conflict policy, e.g. kubectl-edit or an autoscaler.
+	// +optional
+	SkipManagers []string `json:"skipManagers,omitempty"`
+
+	// NamespacePolicy configures the namespace the addon is installed in.
+	// +optional
+	NamespacePolicy *NamespacePolicy `json:"namespacePolicy,omitempty"`
+
+	// DeletionPolicy applies when the ClusterAddon is deleted, it defaults
+	// to Delete.
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// ReadinessTimeout makes kcm wait for the Deployments, StatefulSets and
+	// DaemonSets of the addon to roll out after applying it. The install or
+	// upgrade fails if they are not ready in time.
+	// +optional
+	ReadinessTimeout *metav1.Duration `json:"readinessTimeout,omitempty"`
+
+	// AutoRollback re-applies the installed version when an upgrade fails
+	// after it started changing the cluster, it defaults to true.
+	// +optional
+	AutoRollback *bool `json:"autoRollback,omitempty"`
+
+	// RollbackTo installs the version of a revision from the history of the
+	// addon instead of Version, for as long as it is set.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	RollbackTo *int64 `json:"rollbackTo,omitempty"`
+
+	// RevisionHistoryLimit is the number of revisions kept in the history
+	// of the addon, it defaults to 10.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+
+	// Backoff paces the retries of the addon while it fails.
+	// +optional
+	Backoff *BackoffPolicy `json:"backoff,omitempty"`
+}
+
+// BackoffPolicy makes the delay between retries of a failing addon grow
+// exponentially from Initial up to Max.
+type BackoffPolicy struct {
+	// Initial is the delay before the first retry, it defaults to 10s.
+	// +optional
+	Initial *metav1.Duration `json:"initial,omitempty"`
+
+	// Max is the longest delay between retries, it defaults to 10m.
+	// +optional
+	Max *metav1.Duration `json:"max,omitempty"`
+
+	// JitterPercent randomly lengthens every delay by up to that percentage,
+	// so addons failing together are not retried together. It defaults
+	// to 20.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	JitterPercent *int32 `json:"jitterPercent,omitempty"`
+
+	// MaxAttempts makes kcm give up on the addon after that many failed
+	// attempts, until the ClusterAddon changes. Retries are unlimited when
+	// it is not set.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	MaxAttempts *int32 `json:"maxAttempts,omitempty"`
+}
+
+// NamespacePolicy configures the namespace of an addon.
+type NamespacePolicy struct {
+	// Labels and Annotations are set on the namespace, e.g. the Pod
+	// Security Admission pod-security.kubernetes.io/enforce level.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Owned makes kcm delete the namespace when the addon is uninstalled,
+	// unless it holds resources which are not part of the addon. It
+	// defaults to true, kcm creates the namespace if missing either way.
+	// +optional
+	Owned *bool `json:"owned,omitempty"`
+}
+
+// ImageRewrite rewrites the container images of addon workloads, e.g. to
+// pull them from an internal mirror.
+type ImageRewrite struct {
+	// Rules are tried in order, the first one matching an image applies.
+	// +optional
+	Rules []ImageRewriteRule `json:"rules,omitempty"`
+
+	// Digests pins images, after rewriting, to a digest. Keys are image
+	// references such as mirror.local/ksctl/ka:v0.1.0, matched in their
+	// fully qualified form like the rules.
+	// +optional
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
+// ImageRewriteRule replaces the prefix of an image reference. Images are
+// matched in their fully qualified form, nginx:1.27 is docker.io/library/nginx:1.27,
+// so mapping a whole registry is a rule with prefix docker.io/.
+type ImageRewriteRule struct {
+	Prefix      string `json:"prefix"`
+	Replacement string `json:"replacement"`
+}
+
+// AddonState is the bookkeeping kcm keeps for an installed addon.
+type AddonState struct {
+	Version   string      `json:"version"`
+	Timestamp metav1.Time `json:"timestamp"`
+
+	// Inventory lists the objects applied for the installed version.
+	// +optional
+	Inventory []ObjectReference `json:"inventory,omitempty"`
+
+	// Revision is the revision of the installed version.
+	// +optional
+	Revision int64 `json:"revision,omitempty"`
+
+	// History lists the latest installs, upgrades and rollbacks of the
+	// addon, oldest first.
+	// +optional
+	History []AddonRevision `json:"history,omitempty"`
+}
+
+// AddonRevisionResult is the outcome of applying an addon revision.
+type AddonRevisionResult string
+
+const (
+	AddonRevisionSucceeded AddonRevisionResult = "Succeeded"
+	AddonRevisionFailed    AddonRevisionResult = "Failed"
+	// AddonRevisionRolledBack revisions failed and the previous revision
+	// was applied again.
+	AddonRevisionRolledBack AddonRevisionResult = "RolledBack"
+)
+
+// AddonRevision records one attempt to apply a version of an addon.
+type AddonRevision struct {
+	Revision int64  `json:"revision"`
+	Version  string `json:"version"`
+	// Digest is the sha256 of the objects rendered from the manifest.
+	// +optional
+	Digest    string              `json:"digest,omitempty"`
+	AppliedAt metav1.Time         `json:"appliedAt"`
+	Result    AddonRevisionResult `json:"result"`
+	// Generation of the ClusterAddon which the revision was applied for.
+	// +optional
+	Generation int64 `json:"generation,omitempty"`
+	// RollbackOf is the revision a requested rollback applied again.
+	// +optional
+	RollbackOf int64 `json:"rollbackOf,omitempty"`
+}
+
+// ObjectReference identifies an object rendered from an addon manifest.
+type ObjectReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+// FieldDiff is a single field which differs between the live object and
+// the result of applying the manifest.
+type FieldDiff struct {
+	Path    string `json:"path"`
+	Live    string `json:"live,omitempty"`
+	Desired string `json:"desired,omitempty"`
+}
+
+// ObjectDiff lists the fields an apply would change on an existing object.
+type ObjectDiff struct {
+	ObjectReference `json:",inline"`
+	Fields          []FieldDiff `json:"fields,omitempty"`
+}
+
+// AddonPlan is what kcm would do to a single addon if dry-run was disabled.
+type AddonPlan struct {
+	Name    string          `json:"name"`
+	Version string          `json:"version,omitempty"`
+	Action  AddonPlanAction `json:"action"`
+
+	Create []ObjectReference `json:"create,omitempty"`
+	Update []ObjectDiff      `json:"update,omitempty"`
+	// Prune are objects of the installed version which the new version no longer ships.
+	Prune  []ObjectReference `json:"prune,omitempty"`
+	Delete []ObjectReference `json:"delete,omitempty"`
+	// Hooks are the hook Jobs which would run.
+	Hooks []ObjectReference `json:"hooks,omitempty"`
+}
+
+// ClusterAddonPlan is written to status instead of touching the cluster
+// when a ClusterAddon is in dry-run mode.
+type ClusterAddonPlan struct {
+	GeneratedAt metav1.Time `json:"generatedAt"`
+	Addons      []AddonPlan `json:"addons,omitempty"`
+}
+
+// AddonStatus reports the observed state of a single addon.
+type AddonStatus struct {
+	Name string `json:"name"`
+
+	// Suspended is set while kcm leaves the addon alone.
+	// +optional
+	Suspended bool `json:"suspended,omitempty"`
+
+	// State is only recorded here when kcm uses the status state backend.
+	// +optional
+	State *AddonState `json:"state,omitempty"`
+
+	// PolicyViolations lists the objects of the addon manifest which the
+	// addon policy forbids, nothing is applied while it is not empty.
+	// +optional
+	PolicyViolations []PolicyViolation `json:"policyViolations,omitempty"`
+
+	// Conflicts lists the fields other field managers owned when the addon
+	// was last applied, and what kcm did about them.
+	// +optional
+	Conflicts []FieldConflict `json:"conflicts,omitempty"`
+
+	// Hooks records the last run of each hook Job of the addon.
+	// +optional
+	Hooks []HookStatus `json:"hooks,omitempty"`
+
+	// Readiness is set while kcm waits for the workloads of the addon to
+	// roll out.
+	// +optional
+	Readiness *AddonReadiness `json:"readiness,omitempty"`
+
+	// FailedVersion is the version the last upgrade failed to, it is
+	// cleared once an install or upgrade succeeds.
+	// +optional
+	FailedVersion string `json:"failedVersion,omitempty"`
+
+	// Retry tracks the attempts at the addon while it fails.
+	// +optional
+	Retry *AddonRetry `json:"retry,omitempty"`
+}
+
+// AddonReadiness records the wait for the workloads of an applied version.
+type AddonReadiness struct {
+	Version string `json:"version"`
+	// Deadline is when the addon fails unless its workloads are ready.
+	Deadline metav1.Time `json:"deadline"`
+}
+
+// AddonRetry records the failed attempts at an addon and when it is retried.
+type AddonRetry struct {
+	// Attempts is the number of failed attempts in a row.
+	Attempts int32 `json:"attempts"`
+	// Generation of the ClusterAddon the attempts were made for, a new
+	// generation is attempted right away.
+	Generation int64 `json:"generation"`
+	// NextRetryTime is unset once kcm gave up on the addon.
+	// +optional
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+}
+
+// FieldConflict is a field of an addon object owned by another field manager.
+type FieldConflict struct {
+	ObjectReference `json:",inline"`
+	Manager         string `json:"manager"`
+	Field           string `json:"field"`
+	// Resolution is the conflict policy kcm resolved the conflict with.
+	Resolution ConflictPolicy `json:"resolution"`
+}
+
+// HookType is the lifecycle step a hook Job of an addon runs at.
+type HookType string
+
+const (
+	HookTypePreInstall  HookType = "pre-install"
+	HookTypePostInstall HookType = "post-install"
+	HookTypePreDelete   HookType = "pre-delete"
+	HookTypePostUpgrade HookType = "post-upgrade"
+)
+
+// HookPhase is the outcome of a hook Job.
+type HookPhase string
+
+const (
+	HookPhaseRunning   HookPhase = "Running"
+	HookPhaseSucceeded HookPhase = "Succeeded"
+	HookPhaseFailed    HookPhase = "Failed"
+)
+
+// HookStatus records the last run of a hook Job.
+type HookStatus struct {
+	Name        string       `json:"name"`
+	Namespace   string       `json:"namespace,omitempty"`
+	Type        HookType     `json:"type"`
+	Version     string       `json:"version"`
+	Phase       HookPhase    `json:"phase"`
+	StartedAt   metav1.Time  `json:"startedAt"`
+	CompletedAt *metav1.Time `json:"completedAt,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// PolicyViolation is an object of an addon manifest rejected by the policy.
+type PolicyViolation struct {
+	ObjectReference `json:",inline"`
+	Message         string `json:"message"`
 }
 
 // ClusterAddonSpec defines the desired state of ClusterAddon.
@@ -40,6 +408,44 @@ type ClusterAddonSpec struct {
 	// Important: Run "make" to regenerate code after modifying this file
 
 	Addons []Addon `json:"addons"`
+
+	// DryRun makes kcm perform server-side dry-run applies and report what
+	// it would do in status.plan instead of changing the cluster. Deleting
+	// the ClusterAddon meanwhile leaves its addons installed.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Suspend stops kcm from touching any of the addons, status is still
+	// reported. Reconciliation resumes once it is unset.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// ImageRewrite is applied to the images of every addon.
+	// +optional
+	ImageRewrite *ImageRewrite `json:"imageRewrite,omitempty"`
+
+	// Labels and Annotations are added to every object of every addon. The
+	// manage.ksctl.com labels kcm stamps objects with cannot be overridden.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ValidationRule is a CEL expression evaluated against each manifest object,
+// which is bound to the variable `object`. Objects for which it does not
+// evaluate to true are reported as policy violations, e.g.
+// `object.kind != 'Deployment' || object.spec.template.spec.containers.all(c, has(c.resources.limits))`
+// The rules are listed by the cluster admin in the rules key of the
+// kcm-validation-rules ConfigMap in kcm-system, they apply to every addon of
+// every ClusterAddon.
+type ValidationRule struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+
+	// Message is reported for violating objects, it defaults to the expression.
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // ClusterAddonStatus defines the observed state of ClusterAddon.
@@ -49,6 +455,17 @@ type ClusterAddonStatus struct {
 
 	StatusCode      CAddonStatus `json:"statusCode,omitempty"`
 	ReasonOfFailure string       `json:"reasonOfFailure,omitempty"`
+
+	// ObservedGeneration is the generation of the ClusterAddon the status
+	// was last reported for.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	Addons []AddonStatus `json:"addons,omitempty"`
+
+	// Plan is only set while spec.dryRun is enabled.
+	// +optional
+	Plan *ClusterAddonPlan `json:"plan,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -17,12 +17,18 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"os"
 	"path/filepath"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -32,7 +38,9 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
@@ -41,6 +49,7 @@ import (
 
 	managev1 "github.com/ksctl/kcm/api/v1"
 	"github.com/ksctl/kcm/internal/controller"
+	"github.com/ksctl/kcm/internal/tracing"
 	"github.com/ksctl/ksctl/v2/pkg/poller"
 	// +kubebuilder:scaffold:imports
 )
@@ -66,6 +75,13 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var stateBackend string
+	var impersonate bool
+	var applyConcurrency int
+	var maxConcurrentReconciles int
+	var watchAddonObjects bool
+	rateLimiterOpts := controller.DefaultRateLimiterOptions
+	var tracingOpts tracing.Options
 	var tlsOpts []func(*tls.Config)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
@@ -84,6 +100,34 @@ func main() {
 	flag.StringVar(&metricsCertKey, "metrics-cert-key", "tls.key", "The name of the metrics server key file.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&stateBackend, "state-backend", controller.StateBackendConfigMap,
+		"Where addon state is persisted. One of configmap, secret or status.")
+	flag.BoolVar(&impersonate, "impersonate-addon-service-accounts", true,
+		"If set, the objects of each addon are applied by impersonating the addon's ServiceAccount in kcm-system, "+
+			"so kcm does not need cluster-admin permissions. Otherwise they are applied with kcm's own ServiceAccount.")
+	flag.IntVar(&applyConcurrency, "apply-concurrency", 1,
+		"The number of objects of an addon manifest applied in parallel, among objects whose kind has the same "+
+			"apply priority.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The number of ClusterAddons reconciled at the same time.")
+	flag.BoolVar(&watchAddonObjects, "watch-addon-objects", true,
+		"If set, the objects applied for addons are watched and changes made to them by others are reverted. "+
+			"kcm needs to be allowed to list and watch their kinds.")
+	flag.DurationVar(&rateLimiterOpts.BaseDelay, "rate-limiter-base-delay", rateLimiterOpts.BaseDelay,
+		"The delay before a failed reconcile, e.g. reading a ClusterAddon or writing its status, is retried, doubled on every further failure. "+
+			"Failing addons are retried with their own backoff.")
+	flag.DurationVar(&rateLimiterOpts.MaxDelay, "rate-limiter-max-delay", rateLimiterOpts.MaxDelay,
+		"The longest delay between retries of a failed reconcile.")
+	flag.Float64Var(&rateLimiterOpts.QPS, "rate-limiter-qps", rateLimiterOpts.QPS,
+		"The number of reconciles per second allowed overall, beyond the burst.")
+	flag.IntVar(&rateLimiterOpts.Burst, "rate-limiter-burst", rateLimiterOpts.Burst,
+		"The number of reconciles allowed in a burst overall.")
+	flag.StringVar(&tracingOpts.Endpoint, "otlp-endpoint", "",
+		"The OTLP gRPC endpoint traces are exported to, e.g. otel-collector:4317. Tracing is disabled when empty.")
+	flag.BoolVar(&tracingOpts.Insecure, "otlp-insecure", false,
+		"If set, traces are exported to the OTLP endpoint without TLS.")
+	flag.Float64Var(&tracingOpts.SampleRatio, "trace-sample-ratio", 1,
+		"The fraction of reconciles which are traced, between 0 and 1.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -188,6 +232,13 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "4ebdf65f.ksctl.com",
+		// kcm may only read ConfigMaps and Secrets in its own namespace
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.ConfigMap{}: {Namespaces: map[string]cache.Config{"kcm-system": {}}},
+				&corev1.Secret{}:    {Namespaces: map[string]cache.Config{"kcm-system": {}}},
+			},
+		},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -205,11 +256,45 @@ func main() {
 		os.Exit(1)
 	}
 
+	stateStore, err := controller.NewStateStore(stateBackend, mgr.GetClient())
+	if err != nil {
+		setupLog.Error(err, "unable to create state store", "backend", stateBackend)
+		os.Exit(1)
+	}
+
+	tracerProvider, shutdownTracing, err := tracing.Setup(context.Background(), tracingOpts)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+	stopTracing := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			setupLog.Error(err, "problem flushing traces")
+		}
+	}
+
+	// Addon manifests install CRDs and then objects of their kinds, the
+	// reconciler resets its RESTMapper to pick the new kinds up
+	discoveryClient := discovery.NewDiscoveryClientForConfigOrDie(mgr.GetConfig())
+	restMapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+
 	if err = (&controller.ClusterAddonReconciler{
-		Client:        mgr.GetClient(),
-		DynamicClient: dynamic.NewForConfigOrDie(mgr.GetConfig()),
-		RESTMapper:    mgr.GetRESTMapper(),
-		Scheme:        mgr.GetScheme(),
+		Client:                          mgr.GetClient(),
+		DynamicClient:                   dynamic.NewForConfigOrDie(mgr.GetConfig()),
+		Discovery:                       discoveryClient,
+		RESTMapper:                      restMapper,
+		Scheme:                          mgr.GetScheme(),
+		Recorder:                        mgr.GetEventRecorderFor("clusteraddon-controller"),
+		TracerProvider:                  tracerProvider,
+		State:                           stateStore,
+		ImpersonateAddonServiceAccounts: impersonate,
+		RestConfig:                      mgr.GetConfig(),
+		ApplyConcurrency:                applyConcurrency,
+		MaxConcurrentReconciles:         maxConcurrentReconciles,
+		RateLimiter:                     controller.NewRateLimiter(rateLimiterOpts),
+		WatchAddonObjects:               watchAddonObjects,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ClusterAddon")
 		os.Exit(1)
@@ -247,6 +332,8 @@ func main() {
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
+		stopTracing()
 		os.Exit(1)
 	}
+	stopTracing()
 }
@@ -2,25 +2,28 @@ package controller
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"time"
 
-	"github.com/gookit/goutil/dump"
 	"github.com/ksctl/ksctl/v2/pkg/poller"
-	corev1 "k8s.io/api/core/v1"
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/util/retry"
-	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
 )
 
+const fieldManager = "cluster-addon-controller"
+
 type AddonURL func(version string) string
 
 type AddonManifest struct {
@@ -28,187 +31,551 @@ type AddonManifest struct {
 	Repo      string
 	URL       AddonURL
 	Namespace *string
+	// ServiceAccount in kcm-system which is impersonated to apply the addon
+	// when kcm runs with --impersonate-addon-service-accounts.
+	ServiceAccount string
+	// Policy restricts what the manifest of the addon may contain.
+	Policy AddonPolicy
 }
 
 var addonManifests = map[string]AddonManifest{
 	"stack": {
-		Org:  "ksctl",
-		Repo: "ka",
+		Org:            "ksctl",
+		Repo:           "ka",
+		ServiceAccount: "kcm-addon-stack",
 		URL: func(version string) string {
 			return fmt.Sprintf("https://github.com/ksctl/ka/releases/download/%s/install.yaml", version)
 		},
+		// The kinds of a kubebuilder install.yaml, in the namespace it ships
+		Policy: AddonPolicy{
+			AllowedKinds: []schema.GroupKind{
+				{Kind: "Namespace"},
+				{Kind: "ServiceAccount"},
+				{Kind: "Service"},
+				{Kind: "ConfigMap"},
+				{Group: "apps", Kind: "Deployment"},
+				{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"},
+				{Group: "rbac.authorization.k8s.io", Kind: "Role"},
+				{Group: "rbac.authorization.k8s.io", Kind: "RoleBinding"},
+				{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole"},
+				{Group: "rbac.authorization.k8s.io", Kind: "ClusterRoleBinding"},
+			},
+			AllowedNamespaces: []string{"ka-system"},
+		},
 	},
 }
 
-func (r *ClusterAddonReconciler) CreateNamespaceIfNotExists(ctx context.Context, namespace string) error {
-	ns := &corev1.Namespace{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: namespace,
-		},
+func (r *ClusterAddonReconciler) resolveVersion(
+	ctx context.Context,
+	manifest AddonManifest,
+	addon managev1.Addon,
+	state *managev1.AddonState,
+) (_ string, err error) {
+	if addon.Version != nil {
+		return *addon.Version, nil
 	}
-	if err := r.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
-		if errors.IsNotFound(err) {
-			return r.Create(ctx, ns)
-		}
-		return err
+	if state != nil {
+		return state.Version, nil
 	}
-	return nil
-}
 
-func (r *ClusterAddonReconciler) DeleteNamespaceIfExists(ctx context.Context, namespace string) error {
-	ns := &corev1.Namespace{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: namespace,
-		},
+	_, span := r.startSpan(ctx, "resolveVersion", attribute.String("addon", addon.Name))
+	defer func() { endSpan(span, err) }()
+
+	v, err := poller.GetSharedPoller().Get(manifest.Org, manifest.Repo)
+	if err != nil {
+		return "", fmt.Errorf("failed to get latest release of %s/%s: %w", manifest.Org, manifest.Repo, err)
 	}
-	if err := r.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
-		if errors.IsNotFound(err) {
-			return nil
-		}
-		return err
+	if len(v) == 0 {
+		return "", fmt.Errorf("no releases found for %s/%s", manifest.Org, manifest.Repo)
 	}
-	return r.Delete(ctx, ns)
+	return v[0], nil
 }
 
-func (r *ClusterAddonReconciler) GetData(ctx context.Context) (*corev1.ConfigMap, error) {
-	cf := &corev1.ConfigMap{}
+func (r *ClusterAddonReconciler) HandleAddon(ctx context.Context, instance *managev1.ClusterAddon, addon managev1.Addon) (err error) {
+	manifest, ok := addonManifests[addon.Name]
+	if !ok {
+		return fmt.Errorf("addon %s not found in manifest registry", addon.Name)
+	}
 
-	if err := r.Get(ctx, client.ObjectKey{Namespace: "kcm-system", Name: "kcm-addons"}, cf); err != nil {
-		if errors.IsNotFound(err) {
-			cf = &corev1.ConfigMap{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      "kcm-addons",
-					Namespace: "kcm-system",
-				},
-				Data: map[string]string{},
-			}
-			if err := r.Create(ctx, cf); err != nil {
-				return nil, err
+	unlock := r.lockAddon(addon.Name)
+	defer unlock()
+
+	state, err := r.stateStore().Get(ctx, instance, addon.Name)
+	if err != nil {
+		return fmt.Errorf("failed to get addon state: %w", err)
+	}
+
+	var addonVersion string
+	if addon.RollbackTo != nil {
+		addonVersion, err = revisionVersion(state, *addon.RollbackTo)
+	} else {
+		addonVersion, err = r.resolveVersion(ctx, manifest, addon, state)
+	}
+	if err != nil {
+		versionResolutionFailuresTotal.WithLabelValues(addon.Name).Inc()
+		r.warning(instance, EventReasonVersionResolutionFailed, "Failed to resolve version of addon %s: %v", addon.Name, err)
+		return err
+	}
+	l := log.FromContext(ctx).WithValues("version", addonVersion)
+	ctx = log.IntoContext(ctx, l)
+
+	plan := startPlan(instance, addon.Name, addonVersion)
+
+	// The installed version is applied again once the ClusterAddon changed,
+	// its labels or image rewrites may change the objects of the addon
+	reconfigure := false
+	if state != nil && state.Version == addonVersion {
+		setInstalledVersion(addon.Name, addonVersion)
+		rev := currentRevision(state)
+		reconfigure = rev != nil && rev.Generation != instance.Generation
+		if !reconfigure {
+			if plan != nil {
+				return nil
 			}
-			return cf, nil
+			return r.checkInstalled(ctx, instance, addon, manifest, state)
 		}
-		return nil, err
 	}
-	if cf.Data == nil {
-		cf.Data = map[string]string{}
+
+	if plan == nil && addon.RollbackTo == nil && rolledBack(instance, addon.Name, state, addonVersion) {
+		return fmt.Errorf("upgrade of addon %s to %s was rolled back, it is retried once the ClusterAddon changes",
+			addon.Name, addonVersion)
 	}
 
-	return cf, nil
-}
+	announce := r.announcer(instance, addon.Name, addonVersion)
 
-func (r *ClusterAddonReconciler) UpdateData(ctx context.Context, cf *corev1.ConfigMap) error {
-	if err := r.Update(ctx, cf); err != nil {
-		if errors.IsNotFound(err) {
-			return r.Create(ctx, cf)
+	resolver := newConflictResolver(addon)
+	apply, prune := r.applyResource(resolver), r.pruneResource
+	switch {
+	case plan != nil:
+		apply, prune = r.planApply(plan, nil, resolver), r.planPrune(plan)
+		plan.Action = managev1.AddonPlanActionInstall
+		if state != nil {
+			plan.Action = managev1.AddonPlanActionUpgrade
 		}
-		return err
+	case reconfigure:
+		// Announced once the manifest turns out to change
+	case addon.RollbackTo != nil:
+		l.Info("Rolling back addon", "from", state.Version, "revision", *addon.RollbackTo)
+		announce(instance, EventReasonRollbackStarted, "Rolling back addon %s from %s to revision %d (%s)",
+			addon.Name, state.Version, *addon.RollbackTo, addonVersion)
+		defer func() { recordOperation(addon.Name, operationRollback, err) }()
+	case state != nil:
+		l.Info("Upgrading addon", "from", state.Version)
+		announce(instance, EventReasonUpgradeStarted, "Upgrading addon %s from %s to %s", addon.Name, state.Version, addonVersion)
+		defer func() { recordOperation(addon.Name, operationUpgrade, err) }()
+	default:
+		l.Info("Installing addon")
+		announce(instance, EventReasonInstallStarted, "Installing addon %s %s", addon.Name, addonVersion)
+		defer func() { recordOperation(addon.Name, operationInstall, err) }()
 	}
-	return nil
-}
 
-func (r *ClusterAddonReconciler) HandleAddon(ctx context.Context, addonName string, addonVer *string) error {
-	manifest, ok := addonManifests[addonName]
-	if !ok {
-		return fmt.Errorf("addon %s not found in manifest registry", addonName)
+	if manifest.Namespace != nil {
+		if plan != nil {
+			if err := apply(ctx, namespaceObject(*manifest.Namespace, addon)); err != nil {
+				return fmt.Errorf("failed to plan namespace for ADDON %s: %w", *manifest.Namespace, err)
+			}
+		} else if err := r.CreateNamespaceIfNotExists(ctx, instance, addon, *manifest.Namespace); err != nil {
+			return fmt.Errorf("failed to create namespace for ADDON %s: %w", *manifest.Namespace, err)
+		}
 	}
 
-	cf, err := r.GetData(ctx)
+	objs, err := r.renderManifest(ctx, instance, addon, manifest, addonVersion)
 	if err != nil {
-		return fmt.Errorf("failed to get/create config map: %w", err)
+		return fmt.Errorf("failed to install addon %s: %w", addon.Name, err)
 	}
 
-	if _, installed := cf.Data[addonName]; installed {
-		return nil
+	if err := r.enforcePolicy(ctx, instance, addon.Name, manifest, addonVersion, objs); err != nil {
+		return err
 	}
 
-	if manifest.Namespace != nil {
-		if err := r.CreateNamespaceIfNotExists(ctx, *manifest.Namespace); err != nil {
-			return fmt.Errorf("failed to create namespace for ADDON %s: %w", *manifest.Namespace, err)
+	objs, hooks, err := splitHooks(objs)
+	if err != nil {
+		return fmt.Errorf("failed to install addon %s: %w", addon.Name, err)
+	}
+
+	if reconfigure {
+		digest, err := manifestDigest(objs)
+		if err != nil {
+			return fmt.Errorf("failed to digest manifest: %w", err)
+		}
+		if digest == currentRevision(state).Digest {
+			// Nothing the ClusterAddon changed affects the addon
+			if plan != nil {
+				return nil
+			}
+			return r.keepRevision(ctx, instance, addon, manifest, state)
+		}
+	}
+	if plan != nil {
+		apply = r.planApply(plan, crdKinds(objs), resolver)
+	} else if reconfigure {
+		l.Info("Reapplying addon for the changed ClusterAddon")
+		defer func() { recordOperation(addon.Name, operationUpgrade, err) }()
+	}
+
+	if state == nil {
+		if err := r.runHooks(ctx, instance, addon.Name, addonVersion, plan, hooks, managev1.HookTypePreInstall); err != nil {
+			return fmt.Errorf("failed to install addon %s: %w", addon.Name, err)
 		}
 	}
-	addonVersion := ""
 
-	if addonVer == nil {
-		v, err := poller.GetSharedPoller().Get(manifest.Org, manifest.Repo)
+	postHook := managev1.HookTypePostInstall
+	if state != nil {
+		postHook = managev1.HookTypePostUpgrade
+	}
+	// While the workloads roll out or a post hook Job runs the objects were
+	// applied already, they are not applied again every time they are checked
+	hooking := hooksRunning(instance, addon.Name, addonVersion, postHook)
+	readiness := addonStatus(instance, addon.Name).Readiness
+	polling := plan == nil && (hooking || readiness != nil && readiness.Version == addonVersion)
+
+	// Everything from here on changes the cluster, an upgrade failing midway
+	// is rolled back to the installed version
+	applyErr := func() error {
+		if !polling {
+			err := r.applyStaged(ctx, objs, apply, plan == nil)
+			// A plan reports the conflicts the apply would run into
+			conflicts := resolver.Conflicts()
+			addonStatus(instance, addon.Name).Conflicts = conflicts
+			if plan == nil && len(conflicts) > 0 {
+				r.warning(instance, EventReasonFieldConflict, "Addon %s %s has %d fields owned by other field managers, see status",
+					addon.Name, addonVersion, len(conflicts))
+			}
+			if err != nil {
+				r.warning(instance, EventReasonApplyFailed, "Failed to apply addon %s %s: %v", addon.Name, addonVersion, err)
+				return fmt.Errorf("failed to install addon %s: %w", addon.Name, err)
+			}
+			if plan == nil {
+				objectsAppliedTotal.WithLabelValues(addon.Name).Add(float64(len(objs)))
+			}
+
+			if state != nil {
+				// Upgrading, remove whatever the installed version shipped which the new one does not
+				prev, err := r.installedObjects(ctx, instance, addon.Name, manifest, state)
+				if err != nil {
+					r.warning(instance, EventReasonDownloadFailed, "Failed to list objects of addon %s %s: %v", addon.Name, state.Version, err)
+					return fmt.Errorf("failed to upgrade addon %s: %w", addon.Name, err)
+				}
+
+				if err := operateResources(ctx, deletionOrder(staleObjects(prev, slices.Concat(objs, hooks))), prune); err != nil {
+					r.warning(instance, EventReasonDeleteFailed, "Failed to prune addon %s %s: %v", addon.Name, state.Version, err)
+					return fmt.Errorf("failed to upgrade addon %s: %w", addon.Name, err)
+				}
+			}
+		}
+
+		if plan == nil && addon.ReadinessTimeout != nil && !hooking {
+			if err := r.checkReady(ctx, instance, addon, addonVersion, objs); err != nil {
+				if !pending(err) {
+					r.warning(instance, EventReasonNotReady, "Addon %s %s did not become ready: %v", addon.Name, addonVersion, err)
+				}
+				return fmt.Errorf("failed to install addon %s: %w", addon.Name, err)
+			}
+		}
+
+		if err := r.runHooks(ctx, instance, addon.Name, addonVersion, plan, hooks, postHook); err != nil {
+			return fmt.Errorf("failed to install addon %s: %w", addon.Name, err)
+		}
+		return nil
+	}()
+	if applyErr != nil {
+		if state == nil || plan != nil || pending(applyErr) {
+			return applyErr
+		}
+
+		result := managev1.AddonRevisionFailed
+		if autoRollback(addon) {
+			if err := r.rollback(ctx, instance, addon, manifest, state, addonVersion, objs, applyErr); err != nil {
+				applyErr = fmt.Errorf("%w, rolling back to %s failed: %v", applyErr, state.Version, err)
+			} else {
+				result = managev1.AddonRevisionRolledBack
+				applyErr = fmt.Errorf("%w, rolled back to %s", applyErr, state.Version)
+			}
+		}
+
+		rev, err := newRevision(instance, addon, state, addonVersion, objs, result)
 		if err == nil {
-			addonVersion = v[0]
+			err = r.recordFailedRevision(ctx, instance, addon, state, rev)
 		}
-	} else {
-		addonVersion = *addonVer
+		if err != nil {
+			l.Error(err, "Failed to record revision of addon")
+		}
+		return applyErr
+	}
+
+	if plan != nil {
+		return nil
 	}
 
-	if err := r.downloadAndOperateManifests(ctx, manifest, r.applyResource, addonVersion); err != nil {
-		return fmt.Errorf("failed to install addon %s: %w", addonName, err)
+	rev, err := newRevision(instance, addon, state, addonVersion, objs, managev1.AddonRevisionSucceeded)
+	if err != nil {
+		return err
+	}
+	if err := r.storeManifest(ctx, addon.Name, objs); err != nil {
+		return fmt.Errorf("failed to store manifest: %w", err)
+	}
+	var history []managev1.AddonRevision
+	if state != nil {
+		history = state.History
+	}
+	if err := r.stateStore().Set(ctx, instance, addon.Name, managev1.AddonState{
+		Version:   addonVersion,
+		Timestamp: metav1.Now(),
+		Inventory: inventory(slices.Concat(objs, hooks)),
+		Revision:  rev.Revision,
+		History:   appendRevision(history, rev, revisionHistoryLimit(addon)),
+	}); err != nil {
+		return err
 	}
 
-	return r.updateAddonStatus(ctx, cf, addonName, false, addonVersion)
+	setInstalledVersion(addon.Name, addonVersion)
+	addonStatus(instance, addon.Name).FailedVersion = ""
+	addonStatus(instance, addon.Name).Readiness = nil
+	r.drift.setChecked(instance.Name, addon.Name)
+	if err := r.watchInventory(ctx, inventory(objs)); err != nil {
+		l.Error(err, "Failed to watch objects of addon")
+	}
+	if reconfigure {
+		l.Info("Reapplied addon")
+		r.event(instance, EventReasonReapplied, "Reapplied addon %s %s for the changed ClusterAddon", addon.Name, addonVersion)
+	} else if addon.RollbackTo != nil {
+		l.Info("Rolled back addon", "from", state.Version, "revision", rev.RollbackOf)
+		r.event(instance, EventReasonRolledBack, "Rolled back addon %s to revision %d (%s)", addon.Name, rev.RollbackOf, addonVersion)
+	} else if state != nil {
+		l.Info("Upgraded addon", "from", state.Version)
+		r.event(instance, EventReasonUpgraded, "Upgraded addon %s to %s", addon.Name, addonVersion)
+	} else {
+		l.Info("Installed addon")
+		r.event(instance, EventReasonInstalled, "Installed addon %s %s", addon.Name, addonVersion)
+	}
+	return nil
 }
 
-func (r *ClusterAddonReconciler) HandleAddonDelete(ctx context.Context, addonName string, addonVer *string) error {
-	cf, err := r.GetData(ctx)
+func (r *ClusterAddonReconciler) HandleAddonDelete(ctx context.Context, instance *managev1.ClusterAddon, addon managev1.Addon) (err error) {
+	unlock := r.lockAddon(addon.Name)
+	defer unlock()
+
+	state, err := r.stateStore().Get(ctx, instance, addon.Name)
 	if err != nil {
-		return fmt.Errorf("failed to get/create config map: %w", err)
+		return fmt.Errorf("failed to get addon state: %w", err)
 	}
 
-	if _, installed := cf.Data[addonName]; !installed {
+	if state == nil {
 		return nil
 	}
 
-	manifest, ok := addonManifests[addonName]
+	manifest, ok := addonManifests[addon.Name]
 	if !ok {
-		return fmt.Errorf("addon %s not found in manifest registry", addonName)
+		return fmt.Errorf("addon %s not found in manifest registry", addon.Name)
+	}
+
+	addonVersion, err := r.resolveVersion(ctx, manifest, addon, state)
+	if err != nil {
+		versionResolutionFailuresTotal.WithLabelValues(addon.Name).Inc()
+		r.warning(instance, EventReasonVersionResolutionFailed, "Failed to resolve version of addon %s: %v", addon.Name, err)
+		return err
 	}
+	l := log.FromContext(ctx).WithValues("version", addonVersion)
+	ctx = log.IntoContext(ctx, l)
 
-	addonVersion := ""
+	policy := addon.DeletionPolicy
+	if policy == "" {
+		policy = managev1.DeletionPolicyDelete
+	}
 
-	if addonVer == nil {
-		v := cf.Data[addonName]
-		_v := AddonState{}
-		_ = json.Unmarshal([]byte(v), &_v)
-		addonVersion = _v.Ver
+	announce := r.announcer(instance, addon.Name, addonVersion)
+
+	// A retried uninstall finds some objects gone already
+	remove := r.pruneResource
+	plan := startPlan(instance, addon.Name, addonVersion)
+	if plan != nil {
+		plan.Action = managev1.AddonPlanActionUninstall
+		remove = r.planDelete(plan)
+	} else if policy == managev1.DeletionPolicyOrphan {
+		l.Info("Orphaning addon")
 	} else {
-		addonVersion = *addonVer
+		l.Info("Uninstalling addon")
+		announce(instance, EventReasonUninstallStarted, "Uninstalling addon %s %s", addon.Name, addonVersion)
+		defer func() { recordOperation(addon.Name, operationUninstall, err) }()
+	}
+
+	if policy == managev1.DeletionPolicyOrphan {
+		if plan != nil {
+			return nil
+		}
+		if err := r.forgetAddon(ctx, instance, addon.Name); err != nil {
+			return err
+		}
+		l.Info("Orphaned addon")
+		r.event(instance, EventReasonOrphaned, "Orphaned addon %s %s, its objects were left in place", addon.Name, addonVersion)
+		return nil
+	}
+
+	objs, err := r.installedObjects(ctx, instance, addon.Name, manifest, state)
+	if err != nil {
+		r.warning(instance, EventReasonDeleteFailed, "Failed to list objects of addon %s %s: %v", addon.Name, addonVersion, err)
+		return fmt.Errorf("failed to uninstall addon %s: %w", addon.Name, err)
 	}
 
-	if err := r.downloadAndOperateManifests(ctx, manifest, r.deleteResource, addonVersion); err != nil {
-		return fmt.Errorf("failed to uninstall addon %s: %w", addonName, err)
+	if err := r.runPreDeleteHooks(ctx, instance, addon, manifest, addonVersion, plan); err != nil {
+		return fmt.Errorf("failed to uninstall addon %s: %w", addon.Name, err)
 	}
 
+	if policy == managev1.DeletionPolicyRetainCRDs {
+		objs = slices.DeleteFunc(objs, isCRD)
+	}
+
+	// The namespaces of the addon, whether kcm created them or the manifest
+	// ships them, are only deleted if the namespace policy allows it and they
+	// hold nothing else
+	var namespaces []string
 	if manifest.Namespace != nil {
-		if err := r.DeleteNamespaceIfExists(ctx, *manifest.Namespace); err != nil {
-			return fmt.Errorf("failed to delete namespace for ADDON %s: %w", *manifest.Namespace, err)
+		namespaces = append(namespaces, *manifest.Namespace)
+	}
+	objs = slices.DeleteFunc(objs, func(obj *unstructured.Unstructured) bool {
+		if !isNamespace(obj) {
+			return false
+		}
+		if !slices.Contains(namespaces, obj.GetName()) {
+			namespaces = append(namespaces, obj.GetName())
 		}
+		return true
+	})
+
+	if err := operateResources(ctx, deletionOrder(objs), remove); err != nil {
+		r.warning(instance, EventReasonDeleteFailed, "Failed to uninstall addon %s %s: %v", addon.Name, addonVersion, err)
+		return fmt.Errorf("failed to uninstall addon %s: %w", addon.Name, err)
 	}
 
-	return r.updateAddonStatus(ctx, cf, addonName, true, addonVersion)
+	for _, namespace := range namespaces {
+		if plan == nil {
+			if err := r.DeleteNamespaceIfExists(ctx, instance, addon, namespace); err != nil {
+				return fmt.Errorf("failed to delete namespace for ADDON %s: %w", namespace, err)
+			}
+			continue
+		}
+
+		retain, err := r.retainNamespace(ctx, instance, addon, namespace)
+		if err != nil {
+			return err
+		}
+		if retain == "" {
+			if err := remove(ctx, namespaceObject(namespace, addon)); err != nil {
+				return fmt.Errorf("failed to plan namespace for ADDON %s: %w", namespace, err)
+			}
+		}
+	}
+
+	if plan != nil {
+		return nil
+	}
+
+	if err := r.forgetAddon(ctx, instance, addon.Name); err != nil {
+		return err
+	}
+
+	l.Info("Uninstalled addon")
+	r.event(instance, EventReasonUninstalled, "Uninstalled addon %s %s", addon.Name, addonVersion)
+	return nil
 }
 
-func (r *ClusterAddonReconciler) downloadAndOperateManifests(
+func operateResources(
 	ctx context.Context,
-	manifest AddonManifest,
+	objs []*unstructured.Unstructured,
 	operator func(ctx context.Context, obj *unstructured.Unstructured) error,
-	version string,
 ) error {
-	resp, err := http.Get(manifest.URL(version))
+	for _, obj := range objs {
+		if err := operator(ctx, obj); err != nil {
+			return fmt.Errorf("failed to apply resource %s/%s: %w",
+				obj.GetNamespace(), obj.GetName(), err)
+		}
+	}
+
+	return nil
+}
+
+// renderManifest downloads the manifest of an addon version and renders it
+// the way kcm applies it.
+func (r *ClusterAddonReconciler) renderManifest(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addon managev1.Addon,
+	manifest AddonManifest,
+	version string,
+) ([]*unstructured.Unstructured, error) {
+	objs, err := r.downloadManifest(ctx, addon.Name, manifest, version)
 	if err != nil {
-		return fmt.Errorf("failed to download manifest: %w", err)
+		r.warning(instance, EventReasonDownloadFailed, "Failed to download addon %s %s: %v", addon.Name, version, err)
+		return nil, err
+	}
+
+	if err := rewriteImages(objs, imageRewrite(instance, addon)); err != nil {
+		return nil, fmt.Errorf("failed to rewrite images: %w", err)
+	}
+	setNamespacePolicy(objs, addon)
+	stampObjects(objs, instance, addon, version)
+	return objs, nil
+}
+
+// forgetAddon drops the state kcm keeps for an addon it no longer manages.
+func (r *ClusterAddonReconciler) forgetAddon(ctx context.Context, instance *managev1.ClusterAddon, addonName string) error {
+	if err := r.forgetManifest(ctx, addonName); err != nil {
+		return fmt.Errorf("failed to forget manifest: %w", err)
+	}
+	if err := r.stateStore().Delete(ctx, instance, addonName); err != nil {
+		return err
+	}
+	setInstalledVersion(addonName, "")
+	r.drift.setDrifted(instance.Name, addonName)
+	return nil
+}
+
+func isCRD(obj *unstructured.Unstructured) bool {
+	return obj.GroupVersionKind().GroupKind() == schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}
+}
+
+// downloadManifest fetches the manifest of the given addon version and
+// decodes it into the objects it consists of, in file order.
+func (r *ClusterAddonReconciler) downloadManifest(
+	ctx context.Context,
+	addonName string,
+	manifest AddonManifest,
+	version string,
+) (_ []*unstructured.Unstructured, err error) {
+	ctx, span := r.startSpan(ctx, "downloadManifest",
+		attribute.String("addon", addonName), attribute.String("version", version))
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifest.URL(version), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download manifest: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download manifest: %w", err)
 	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download manifest, status: %d", resp.StatusCode)
+		return nil, fmt.Errorf("failed to download manifest, status: %d", resp.StatusCode)
 	}
 
-	decoder := yaml.NewYAMLOrJSONDecoder(resp.Body, 4096)
+	var objs []*unstructured.Unstructured
+
+	body := &countingReader{Reader: resp.Body}
+	decoder := yaml.NewYAMLOrJSONDecoder(body, 4096)
 	for {
 		var rawObj map[string]interface{}
 		if err := decoder.Decode(&rawObj); err != nil {
 			if err == io.EOF {
 				break
 			}
-			return fmt.Errorf("failed to decode manifest: %w", err)
+			return nil, fmt.Errorf("failed to decode manifest: %w", err)
 		}
 
 		if len(rawObj) == 0 {
@@ -224,107 +591,174 @@ func (r *ClusterAddonReconciler) downloadAndOperateManifests(
 
 		// Validate required fields
 		if obj.GetAPIVersion() == "" || obj.GetKind() == "" {
-			return fmt.Errorf("manifest missing apiVersion or kind")
+			return nil, fmt.Errorf("manifest missing apiVersion or kind")
 		}
 
-		if err := operator(ctx, obj); err != nil {
-			return fmt.Errorf("failed to apply resource %s/%s: %w",
-				obj.GetNamespace(), obj.GetName(), err)
+		objs = append(objs, obj)
+	}
+
+	manifestDownloadDuration.WithLabelValues(addonName).Observe(time.Since(start).Seconds())
+	manifestDownloadBytes.WithLabelValues(addonName).Observe(float64(body.n))
+
+	return objs, nil
+}
+
+// staleObjects returns the objects of prev which are no longer part of next.
+func staleObjects(prev, next []*unstructured.Unstructured) []*unstructured.Unstructured {
+	keep := make(map[managev1.ObjectReference]struct{}, len(next))
+	for _, obj := range next {
+		keep[objectKey(obj)] = struct{}{}
+	}
+
+	var stale []*unstructured.Unstructured
+	for _, obj := range prev {
+		if _, ok := keep[objectKey(obj)]; !ok {
+			stale = append(stale, obj)
 		}
 	}
+	return stale
+}
+
+// objectKey identifies an object independently of the version of its API.
+func objectKey(obj *unstructured.Unstructured) managev1.ObjectReference {
+	return managev1.ObjectReference{
+		APIVersion: obj.GroupVersionKind().Group,
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+	}
+}
 
-	return nil
+func objectReference(obj *unstructured.Unstructured) managev1.ObjectReference {
+	return managev1.ObjectReference{
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+	}
+}
+
+func namespaceObject(name string, addon managev1.Addon) *unstructured.Unstructured {
+	policy := namespacePolicy(addon)
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Namespace")
+	obj.SetName(name)
+	if len(policy.Labels) > 0 {
+		obj.SetLabels(policy.Labels)
+	}
+	if len(policy.Annotations) > 0 {
+		obj.SetAnnotations(policy.Annotations)
+	}
+	return obj
 }
 
-func (r *ClusterAddonReconciler) deleteResource(ctx context.Context, obj *unstructured.Unstructured) error {
+// resourceInterface returns the dynamic client for the resource obj belongs to.
+func (r *ClusterAddonReconciler) resourceInterface(ctx context.Context, obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
 	// Get the GVK for the resource
 	gvk := obj.GroupVersionKind()
 
 	// Get the corresponding REST mapping
-	mapping, err := r.RESTMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	mapping, err := r.restMapping(ctx, gvk)
 	if err != nil {
-		return fmt.Errorf("failed to get REST mapping: %w", err)
+		return nil, fmt.Errorf("failed to get REST mapping: %w", err)
 	}
 
 	// Create dynamic resource interface
-	var dr dynamic.ResourceInterface
 	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
 		// Namespaced resources
-		dr = r.DynamicClient.Resource(mapping.Resource).Namespace(obj.GetNamespace())
-	} else {
-		// Cluster-scoped resources
-		dr = r.DynamicClient.Resource(mapping.Resource)
+		return r.dynamicClient(ctx).Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+	}
+	// Cluster-scoped resources
+	return r.dynamicClient(ctx).Resource(mapping.Resource), nil
+}
+
+func (r *ClusterAddonReconciler) deleteResource(ctx context.Context, obj *unstructured.Unstructured) (err error) {
+	ctx, span := r.startSpan(ctx, "deleteResource", objectAttributes(obj)...)
+	defer func() { endSpan(span, err) }()
+
+	dr, err := r.resourceInterface(ctx, obj)
+	if err != nil {
+		return err
 	}
 
-	// Apply the resource using server-side apply
 	opts := metav1.DeleteOptions{}
 
+	l := objectLogger(ctx, obj)
+
 	err = dr.Delete(ctx, obj.GetName(), opts)
 	if err != nil {
-		fmt.Println("Failed to delete resource", obj.GetNamespace(), obj.GetName())
-		dump.Println(obj)
+		if errors.IsNotFound(err) {
+			l.V(logLevelDebug).Info("Resource already deleted")
+		} else {
+			l.Error(err, "Failed to delete resource")
+			dumpObject(l, "Resource which failed to delete", obj)
+		}
 		return fmt.Errorf("failed to delete resource: %w", err)
 	}
 
-	fmt.Println("Delete resource", obj.GetNamespace(), obj.GetName())
+	l.V(logLevelDebug).Info("Deleted resource")
 
 	return nil
 }
 
-func (r *ClusterAddonReconciler) applyResource(ctx context.Context, obj *unstructured.Unstructured) error {
-	// Get the GVK for the resource
-	gvk := obj.GroupVersionKind()
-
-	// Get the corresponding REST mapping
-	mapping, err := r.RESTMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
-	if err != nil {
-		return fmt.Errorf("failed to get REST mapping: %w", err)
+// pruneResource deletes an object kcm applied before, it is fine for the
+// object to be gone already, its kind included.
+func (r *ClusterAddonReconciler) pruneResource(ctx context.Context, obj *unstructured.Unstructured) error {
+	if err := r.deleteResource(ctx, obj); err != nil && !errors.IsNotFound(err) && !meta.IsNoMatchError(err) {
+		return err
 	}
+	return nil
+}
 
-	// Create dynamic resource interface
-	var dr dynamic.ResourceInterface
-	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
-		// Namespaced resources
-		dr = r.DynamicClient.Resource(mapping.Resource).Namespace(obj.GetNamespace())
-	} else {
-		// Cluster-scoped resources
-		dr = r.DynamicClient.Resource(mapping.Resource)
+// applyResource returns the operator which server-side applies objects,
+// handling conflicts with other field managers according to the resolver.
+func (r *ClusterAddonReconciler) applyResource(resolver *conflictResolver) func(ctx context.Context, obj *unstructured.Unstructured) error {
+	return func(ctx context.Context, obj *unstructured.Unstructured) error {
+		_, err := r.applyObject(ctx, obj, resolver)
+		return err
 	}
+}
 
-	// Apply the resource using server-side apply
-	opts := metav1.ApplyOptions{
-		FieldManager: "cluster-addon-controller",
-		Force:        true,
-	}
+// applyObject server-side applies obj and returns the object as applied.
+func (r *ClusterAddonReconciler) applyObject(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+	resolver *conflictResolver,
+) (applied *unstructured.Unstructured, err error) {
+	ctx, span := r.startSpan(ctx, "applyResource", objectAttributes(obj)...)
+	defer func() { endSpan(span, err) }()
 
-	_, err = dr.Apply(ctx, obj.GetName(), obj, opts)
+	dr, err := r.resourceInterface(ctx, obj)
 	if err != nil {
-		fmt.Println("Failed to apply resource", obj.GetNamespace(), obj.GetName())
-		dump.Println(obj)
-		return fmt.Errorf("failed to apply resource: %w", err)
+		return nil, err
 	}
 
-	fmt.Println("Applied resource", obj.GetNamespace(), obj.GetName())
+	l := objectLogger(ctx, obj)
 
-	return nil
-}
+	// Apply the resource using server-side apply, forcing only once the
+	// conflict policy allows taking over the conflicting fields
+	applied, err = dr.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{FieldManager: fieldManager})
+	if conflicts := fieldConflicts(obj, err); len(conflicts) > 0 {
+		l.Info("Resource has fields owned by other managers", "conflicts", len(conflicts), "policy", resolver.policy)
 
-func (r *ClusterAddonReconciler) updateAddonStatus(ctx context.Context, cf *corev1.ConfigMap, addonName string, isDelete bool, addonVer string) error {
-	return retry.OnError(retry.DefaultRetry, errors.IsConflict, func() error {
-		if isDelete {
-			delete(cf.Data, addonName)
-		} else {
-			if cf.Data == nil {
-				cf.Data = map[string]string{}
-			}
-			v, _ := json.Marshal(AddonState{Ver: addonVer, Timestamp: time.Now().UTC()})
-			cf.Data[addonName] = string(v)
+		var forced *unstructured.Unstructured
+		if forced, err = r.applyConflicting(ctx, obj, resolver, conflicts, err); err == nil {
+			applied, err = dr.Apply(ctx, obj.GetName(), forced, metav1.ApplyOptions{
+				FieldManager: fieldManager,
+				Force:        true,
+			})
 		}
-		return r.Update(ctx, cf)
-	})
-}
+	}
+	if err != nil {
+		l.Error(err, "Failed to apply resource")
+		dumpObject(l, "Resource which failed to apply", obj)
+		return nil, fmt.Errorf("failed to apply resource: %w", err)
+	}
+
+	l.V(logLevelDebug).Info("Applied resource")
+	dumpObject(l, "Applied resource", obj)
 
-type AddonState struct {
-	Ver       string    `json:"version"`
-	Timestamp time.Time `json:"timestamp"`
+	return applied, nil
 }
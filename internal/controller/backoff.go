@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+const (
+	defaultBackoffInitial       = 10 * time.Second
+	defaultBackoffMax           = 10 * time.Minute
+	defaultBackoffJitterPercent = 20
+)
+
+// backoffDelay returns the delay before retrying the addon after attempts
+// failed attempts in a row.
+func backoffDelay(addon managev1.Addon, attempts int32) time.Duration {
+	initial, maxDelay, jitter := defaultBackoffInitial, defaultBackoffMax, int32(defaultBackoffJitterPercent)
+	if p := addon.Backoff; p != nil {
+		if p.Initial != nil && p.Initial.Duration > 0 {
+			initial = p.Initial.Duration
+		}
+		if p.Max != nil && p.Max.Duration > 0 {
+			maxDelay = p.Max.Duration
+		}
+		if p.JitterPercent != nil {
+			jitter = *p.JitterPercent
+		}
+	}
+
+	delay := initial
+	for i := int32(1); i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	if jitter <= 0 {
+		return delay
+	}
+	return wait.Jitter(delay, float64(jitter)/100)
+}
+
+func retriesExhausted(addon managev1.Addon, retry *managev1.AddonRetry) bool {
+	return addon.Backoff != nil && addon.Backoff.MaxAttempts != nil && retry.Attempts >= *addon.Backoff.MaxAttempts
+}
+
+// backingOff reports whether the addon failed recently enough to not be
+// attempted yet, and how long until its next retry. No retry is due if kcm
+// gave up on the addon.
+func backingOff(instance *managev1.ClusterAddon, addon managev1.Addon, now time.Time) (bool, time.Duration) {
+	if instance.Spec.Suspend || addon.Suspended {
+		return false, 0
+	}
+
+	retry := addonStatus(instance, addon.Name).Retry
+	if retry == nil || retry.Generation != instance.Generation {
+		return false, 0
+	}
+	if retry.NextRetryTime == nil {
+		return true, 0
+	}
+	if d := retry.NextRetryTime.Sub(now); d > 0 {
+		return true, d
+	}
+	return false, 0
+}
+
+// recordFailure counts a failed attempt at the addon and returns when to
+// retry it, or zero if kcm gives up on it.
+func (r *ClusterAddonReconciler) recordFailure(instance *managev1.ClusterAddon, addon managev1.Addon, err error, now time.Time) time.Duration {
+	status := addonStatus(instance, addon.Name)
+	retry := status.Retry
+	if retry == nil || retry.Generation != instance.Generation {
+		retry = &managev1.AddonRetry{Generation: instance.Generation}
+		status.Retry = retry
+	}
+	retry.Attempts++
+	retry.LastError = err.Error()
+	retry.NextRetryTime = nil
+
+	if retriesExhausted(addon, retry) {
+		r.warning(instance, EventReasonRetriesExhausted, "Giving up on addon %s after %d failed attempts: %v", addon.Name, retry.Attempts, err)
+		return 0
+	}
+
+	delay := backoffDelay(addon, retry.Attempts)
+	retry.NextRetryTime = &metav1.Time{Time: now.Add(delay)}
+	return delay
+}
+
+// sooner returns the shorter of two requeue delays, zero meaning none.
+func sooner(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
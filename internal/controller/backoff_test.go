@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Addon backoff", func() {
+	It("grows the delay exponentially up to the maximum", func() {
+		addon := managev1.Addon{Name: "stack", Backoff: &managev1.BackoffPolicy{
+			Initial:       &metav1.Duration{Duration: time.Second},
+			Max:           &metav1.Duration{Duration: 5 * time.Second},
+			JitterPercent: ptr.To[int32](0),
+		}}
+		Expect(backoffDelay(addon, 1)).To(Equal(time.Second))
+		Expect(backoffDelay(addon, 3)).To(Equal(4 * time.Second))
+		Expect(backoffDelay(addon, 30)).To(Equal(5 * time.Second))
+
+		addon.Backoff.JitterPercent = ptr.To[int32](50)
+		Expect(backoffDelay(addon, 2)).To(And(
+			BeNumerically(">=", 2*time.Second),
+			BeNumerically("<=", 3*time.Second),
+		))
+	})
+
+	It("backs off until the retry is due, the spec changes or kcm gives up", func() {
+		now := time.Now()
+		instance := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "backoff", Generation: 1}}
+		addon := managev1.Addon{Name: "stack", Backoff: &managev1.BackoffPolicy{MaxAttempts: ptr.To[int32](2)}}
+		recorder := record.NewFakeRecorder(10)
+		r := &ClusterAddonReconciler{Recorder: recorder}
+
+		delay := r.recordFailure(instance, addon, errors.New("boom"), now)
+		Expect(delay).To(BeNumerically(">=", defaultBackoffInitial))
+
+		ok, wait := backingOff(instance, addon, now)
+		Expect(ok).To(BeTrue())
+		Expect(wait).To(Equal(delay))
+
+		ok, _ = backingOff(instance, addon, now.Add(delay))
+		Expect(ok).To(BeFalse())
+
+		Expect(r.recordFailure(instance, addon, errors.New("boom"), now)).To(BeZero())
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning " + EventReasonRetriesExhausted)))
+		ok, wait = backingOff(instance, addon, now.Add(time.Hour))
+		Expect(ok).To(BeTrue())
+		Expect(wait).To(BeZero())
+
+		instance.Generation = 2
+		ok, _ = backingOff(instance, addon, now)
+		Expect(ok).To(BeFalse())
+		r.recordFailure(instance, addon, errors.New("boom"), now)
+		Expect(addonStatus(instance, "stack").Retry.Attempts).To(Equal(int32(1)))
+	})
+})
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+const (
+	// validationRulesName is the ConfigMap in kcm-system listing the
+	// validation rules, as YAML under validationRulesKey. Those creating
+	// ClusterAddons cannot write to it, unlike the ClusterAddons themselves.
+	validationRulesName = "kcm-validation-rules"
+	validationRulesKey  = "rules"
+
+	// validationRuleCostLimit bounds the evaluation of a rule against a
+	// single object, rules looping over large lists otherwise stall kcm.
+	validationRuleCostLimit = 1000000
+)
+
+// validationRules returns the rules of the kcm-validation-rules ConfigMap,
+// none when it does not exist.
+func (r *ClusterAddonReconciler) validationRules(ctx context.Context) ([]managev1.ValidationRule, error) {
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: stateNamespace, Name: validationRulesName}, cm); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get validation rules: %w", err)
+	}
+
+	var rules []managev1.ValidationRule
+	if err := yaml.Unmarshal([]byte(cm.Data[validationRulesKey]), &rules); err != nil {
+		return nil, fmt.Errorf("failed to decode validation rules: %w", err)
+	}
+	return rules, nil
+}
+
+// compileValidationRule returns the program of a rule, which must evaluate
+// to a bool. Fields of object are dynamically typed, so whether they are bools
+// is only known when the rule is evaluated.
+func compileValidationRule(env *cel.Env, rule managev1.ValidationRule) (cel.Program, error) {
+	ast, iss := env.Compile(rule.Expression)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("invalid validation rule %s: %w", rule.Name, iss.Err())
+	}
+	if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+		return nil, fmt.Errorf("invalid validation rule %s: must evaluate to bool, not %s", rule.Name, ast.OutputType())
+	}
+	return env.Program(ast, cel.CostLimit(validationRuleCostLimit))
+}
+
+// checkValidationRules returns the objects which do not satisfy the rules,
+// an object the rule fails to evaluate on counts as violating it.
+func checkValidationRules(rules []managev1.ValidationRule, objs []*unstructured.Unstructured) ([]managev1.PolicyViolation, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	env, err := cel.NewEnv(cel.Variable("object", cel.DynType))
+	if err != nil {
+		return nil, err
+	}
+
+	programs := make([]cel.Program, 0, len(rules))
+	for _, rule := range rules {
+		prg, err := compileValidationRule(env, rule)
+		if err != nil {
+			return nil, err
+		}
+		programs = append(programs, prg)
+	}
+
+	var violations []managev1.PolicyViolation
+	for _, obj := range objs {
+		for i, prg := range programs {
+			rule := rules[i]
+			message := rule.Message
+			if message == "" {
+				message = rule.Expression
+			}
+
+			out, _, err := prg.Eval(map[string]interface{}{"object": obj.Object})
+			if err != nil {
+				message = fmt.Sprintf("%s (%v)", message, err)
+			} else if ok, _ := out.Value().(bool); ok {
+				continue
+			}
+
+			violations = append(violations, managev1.PolicyViolation{
+				ObjectReference: objectReference(obj),
+				Message:         fmt.Sprintf("rule %s: %s", rule.Name, message),
+			})
+		}
+	}
+	return violations, nil
+}
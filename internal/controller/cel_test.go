@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Validation rules", func() {
+	limits := managev1.ValidationRule{
+		Name:       "limits",
+		Expression: "object.kind != 'Deployment' || object.spec.template.spec.containers.all(c, has(c.resources.limits))",
+		Message:    "containers must set resource limits",
+	}
+
+	deployment := func(name string, resources map[string]interface{}) *unstructured.Unstructured {
+		obj := newObject("apps/v1", "Deployment", "ka", name)
+		Expect(unstructured.SetNestedSlice(obj.Object, []interface{}{
+			map[string]interface{}{"name": name, "resources": resources},
+		}, "spec", "template", "spec", "containers")).To(Succeed())
+		return obj
+	}
+
+	It("reports the objects which do not satisfy a rule", func() {
+		objs := []*unstructured.Unstructured{
+			newObject("v1", "ConfigMap", "ka", "cfg"),
+			deployment("limited", map[string]interface{}{"limits": map[string]interface{}{"cpu": "1"}}),
+			deployment("unlimited", map[string]interface{}{}),
+		}
+
+		violations, err := checkValidationRules([]managev1.ValidationRule{limits}, objs)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violations).To(Equal([]managev1.PolicyViolation{{
+			ObjectReference: objectReference(objs[2]),
+			Message:         "rule limits: containers must set resource limits",
+		}}))
+	})
+
+	It("treats evaluation errors as violations", func() {
+		violations, err := checkValidationRules([]managev1.ValidationRule{{
+			Name:       "replicas",
+			Expression: "object.spec.replicas <= 3",
+		}}, []*unstructured.Unstructured{newObject("v1", "ConfigMap", "ka", "cfg")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violations).To(HaveLen(1))
+		Expect(violations[0].Message).To(HavePrefix("rule replicas: object.spec.replicas <= 3 ("))
+
+		violations, err = checkValidationRules([]managev1.ValidationRule{{
+			Name:       "name",
+			Expression: "object.metadata.name",
+		}}, []*unstructured.Unstructured{newObject("v1", "ConfigMap", "ka", "cfg")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violations).To(HaveLen(1))
+	})
+
+	It("rejects rules which do not compile to a bool", func() {
+		_, err := checkValidationRules([]managev1.ValidationRule{{Name: "name", Expression: "string(object.metadata.name)"}},
+			[]*unstructured.Unstructured{newObject("v1", "ConfigMap", "ka", "cfg")})
+		Expect(err).To(MatchError(ContainSubstring("must evaluate to bool")))
+	})
+
+	It("loads the rules from the ConfigMap in kcm-system", func() {
+		ctx := context.Background()
+		r := &ClusterAddonReconciler{Client: newFakeClient()}
+		rules, err := r.validationRules(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(BeEmpty())
+
+		r.Client = newFakeClient(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kcm-system", Name: validationRulesName},
+			Data: map[string]string{validationRulesKey: `
+- name: limits
+  expression: "object.kind != 'Deployment' || object.spec.template.spec.containers.all(c, has(c.resources.limits))"
+  message: containers must set resource limits
+`},
+		})
+		rules, err = r.validationRules(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(Equal([]managev1.ValidationRule{limits}))
+	})
+
+	It("stops rules exceeding the cost limit", func() {
+		obj := newObject("v1", "ConfigMap", "ka", "cfg")
+		items := make([]interface{}, 2000)
+		for i := range items {
+			items[i] = int64(i)
+		}
+		Expect(unstructured.SetNestedSlice(obj.Object, items, "items")).To(Succeed())
+
+		violations, err := checkValidationRules([]managev1.ValidationRule{{
+			Name:       "quadratic",
+			Expression: "object.items.all(a, object.items.all(b, a >= 0))",
+		}}, []*unstructured.Unstructured{obj})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violations).To(HaveLen(1))
+		Expect(violations[0].Message).To(ContainSubstring("cost limit exceeded"))
+	})
+})
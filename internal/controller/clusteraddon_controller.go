@@ -20,15 +20,29 @@ import (
 	"context"
 	"fmt"
 	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	managev1 "github.com/ksctl/kcm/api/v1"
 )
@@ -37,8 +51,50 @@ import (
 type ClusterAddonReconciler struct {
 	client.Client
 	DynamicClient dynamic.Interface
+	Discovery     discovery.DiscoveryInterface
 	RESTMapper    meta.RESTMapper
 	Scheme        *runtime.Scheme
+	Recorder      record.EventRecorder
+
+	// TracerProvider defaults to the global OpenTelemetry provider.
+	TracerProvider trace.TracerProvider
+
+	// State is where addon bookkeeping is persisted, it defaults to the
+	// kcm-addons ConfigMap when left unset.
+	State StateStore
+
+	// ImpersonateAddonServiceAccounts makes kcm apply and delete the objects
+	// of every addon as the addon's ServiceAccount, built from RestConfig,
+	// so kcm itself only needs a narrow set of permissions.
+	ImpersonateAddonServiceAccounts bool
+	RestConfig                      *rest.Config
+
+	// ApplyConcurrency is the number of objects of the same kind priority
+	// applied in parallel, objects are applied one at a time when it is
+	// below 2.
+	ApplyConcurrency int
+
+	// MaxConcurrentReconciles is the number of ClusterAddons reconciled at
+	// the same time, it defaults to 1.
+	MaxConcurrentReconciles int
+	// RateLimiter defaults to the controller-runtime one.
+	RateLimiter workqueue.TypedRateLimiter[reconcile.Request]
+
+	// WatchAddonObjects makes kcm watch the objects it applied and revert
+	// changes made to them by others.
+	WatchAddonObjects bool
+
+	controller  controller.Controller
+	objectCache cache.Cache
+	watchMu     sync.Mutex
+	watched     map[schema.GroupVersionKind]struct{}
+	drift       driftTracker
+
+	clientsMu sync.Mutex
+	clients   map[string]dynamic.Interface
+
+	stateOnce  sync.Once
+	addonLocks sync.Map
 }
 
 const managerFinalizer string = "finalizer.manage.ksctl.com"
@@ -47,10 +103,25 @@ const managerFinalizer string = "finalizer.manage.ksctl.com"
 // +kubebuilder:rbac:groups=manage.ksctl.com,resources=clusteraddons,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=manage.ksctl.com,resources=clusteraddons/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=manage.ksctl.com,resources=clusteraddons/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups="",namespace=kcm-system,resources=configmaps;secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",namespace=kcm-system,resources=serviceaccounts,resourceNames=kcm-addon-stack,verbs=impersonate
 // +kubebuilder:rbac:urls=/metrics,verbs=get
-// +kubebuilder:rbac:groups=*,resources=*,verbs=*
+//
+// The objects of the addons themselves are applied either with the
+// permissions of each addon's ServiceAccount, listed in resourceNames above,
+// or, with impersonation disabled, with those of
+// config/rbac/addon_manager_role.yaml.
 
 func (r *ClusterAddonReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx, span := r.startSpan(ctx, "Reconcile", attribute.String("clusteraddon", req.Name))
+	res, err := r.reconcile(ctx, req)
+	endSpan(span, err)
+	return res, err
+}
+
+func (r *ClusterAddonReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	l := log.FromContext(ctx)
 	l.Info("Reconciling ClusterAddon", "name", req.NamespacedName)
 
@@ -66,7 +137,7 @@ func (r *ClusterAddonReconciler) Reconcile(ctx context.Context, req ctrl.Request
 
 	if instance.Status.StatusCode == "" {
 		instance.Status.StatusCode = managev1.CAddonStatusPending
-		if err := r.Status().Update(ctx, instance); err != nil {
+		if err := r.updateStatus(ctx, instance); err != nil {
 			l.Error(err, "Failed to update initial status")
 			return ctrl.Result{RequeueAfter: time.Second * 5}, err
 		}
@@ -90,16 +161,28 @@ func (r *ClusterAddonReconciler) handleDeletion(ctx context.Context, instance *m
 		return ctrl.Result{}, nil
 	}
 
-	for _, addon := range instance.Spec.Addons {
-		if err := r.validateAndProcessAddon(ctx, addon, r.HandleAddonDelete); err != nil {
-			l.Error(err, "Failed to process addon", "name", addon.Name)
-			instance.Status.StatusCode = managev1.CAddonStatusFailure
-			instance.Status.ReasonOfFailure = fmt.Sprintf("Failed to process addon %s: %v", addon.Name, err)
-			if updateErr := r.Status().Update(ctx, instance); updateErr != nil {
-				l.Error(updateErr, "Failed to update failure status")
-			}
-			return ctrl.Result{RequeueAfter: time.Second * 30, Requeue: true}, err
+	resetPlan(instance)
+
+	instance.Status.ObservedGeneration = instance.Generation
+	if requeue, unfinished := r.processEachAddon(ctx, instance, r.HandleAddonDelete); unfinished {
+		if err := r.updateStatus(ctx, instance); err != nil {
+			l.Error(err, "Failed to update failure status")
+			return ctrl.Result{RequeueAfter: time.Second * 5}, err
+		}
+		return ctrl.Result{RequeueAfter: requeue}, nil
+	}
+
+	if instance.Spec.DryRun || hasSuspendedAddons(instance) {
+		if err := r.updateStatus(ctx, instance); err != nil {
+			l.Error(err, "Failed to update status")
+			return ctrl.Result{RequeueAfter: time.Second * 5}, err
 		}
+		if !instance.Spec.DryRun {
+			// Hold on to the finalizer, the spec update lifting the suspension resumes the uninstall
+			return ctrl.Result{}, nil
+		}
+		// The uninstall plan was reported, a dry-run leaves the addons installed
+		l.Info("Releasing ClusterAddon in dry-run mode without uninstalling its addons")
 	}
 
 	if _, err := r.removeFinalizer(ctx, instance); err != nil {
@@ -141,22 +224,36 @@ func (r *ClusterAddonReconciler) removeFinalizer(ctx context.Context, instance *
 func (r *ClusterAddonReconciler) processAddons(ctx context.Context, instance *managev1.ClusterAddon) (ctrl.Result, error) {
 	l := log.FromContext(ctx)
 
-	for _, addon := range instance.Spec.Addons {
-		if err := r.validateAndProcessAddon(ctx, addon, r.HandleAddon); err != nil {
-			l.Error(err, "Failed to process addon", "name", addon.Name)
-			instance.Status.StatusCode = managev1.CAddonStatusFailure
-			instance.Status.ReasonOfFailure = fmt.Sprintf("Failed to process addon %s: %v", addon.Name, err)
-			if updateErr := r.Status().Update(ctx, instance); updateErr != nil {
-				l.Error(updateErr, "Failed to update failure status")
-			}
-			return ctrl.Result{RequeueAfter: time.Second * 30, Requeue: true}, err
+	if r.upToDate(instance) {
+		l.V(logLevelDebug).Info("Spec unchanged and no addon drifted, nothing to do")
+		return ctrl.Result{RequeueAfter: time.Minute * 5}, nil
+	}
+
+	resetPlan(instance)
+
+	instance.Status.ObservedGeneration = instance.Generation
+	if requeue, unfinished := r.processEachAddon(ctx, instance, r.HandleAddon); unfinished {
+		if err := r.updateStatus(ctx, instance); err != nil {
+			l.Error(err, "Failed to update failure status")
+			return ctrl.Result{RequeueAfter: time.Second * 5}, err
 		}
+		return ctrl.Result{RequeueAfter: requeue}, nil
+	}
+
+	if instance.Spec.Suspend {
+		instance.Status.StatusCode = managev1.CAddonStatusSuspended
+		instance.Status.ReasonOfFailure = ""
+		if err := r.updateStatus(ctx, instance); err != nil {
+			l.Error(err, "Failed to update suspended status")
+			return ctrl.Result{RequeueAfter: time.Second * 5}, err
+		}
+		return ctrl.Result{}, nil // Resumed by the spec update which unsets suspend
 	}
 
 	// Update success status
 	instance.Status.StatusCode = managev1.CAddonStatusSuccess
 	instance.Status.ReasonOfFailure = ""
-	if err := r.Status().Update(ctx, instance); err != nil {
+	if err := r.updateStatus(ctx, instance); err != nil {
 		l.Error(err, "Failed to update success status")
 		return ctrl.Result{RequeueAfter: time.Second * 5}, err
 	}
@@ -164,23 +261,195 @@ func (r *ClusterAddonReconciler) processAddons(ctx context.Context, instance *ma
 	return ctrl.Result{RequeueAfter: time.Minute * 5}, nil // Periodic reconciliation
 }
 
+// upToDate reports whether the addons were installed successfully for the
+// current spec and none of them may have drifted since, addons are checked
+// once after kcm starts. Dry-runs are planned again every time, the cluster
+// may have changed.
+func (r *ClusterAddonReconciler) upToDate(instance *managev1.ClusterAddon) bool {
+	if instance.Status.ObservedGeneration != instance.Generation ||
+		instance.Status.StatusCode != managev1.CAddonStatusSuccess ||
+		instance.Spec.DryRun {
+		return false
+	}
+	for _, addon := range instance.Spec.Addons {
+		if r.drift.drifted(instance.Name, addon.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// processEachAddon runs process for every addon which is not backing off
+// after failing. Failed addons are retried with their backoff policy rather
+// than the workqueue's, addons waiting for hook Jobs once those had time to
+// complete. It returns when the first of them is due and whether any addon
+// failed or is still waiting, in which case the status says so.
+func (r *ClusterAddonReconciler) processEachAddon(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	process func(ctx context.Context, instance *managev1.ClusterAddon, addon managev1.Addon) error,
+) (time.Duration, bool) {
+	l := log.FromContext(ctx)
+
+	pruneAddonStatus(instance)
+
+	var requeue time.Duration
+	var reasons []string
+	var waiting bool
+	for _, addon := range instance.Spec.Addons {
+		if ok, wait := backingOff(instance, addon, time.Now()); ok {
+			retry := addonStatus(instance, addon.Name).Retry
+			l.V(logLevelDebug).Info("Addon is backing off", "addon", addon.Name, "attempts", retry.Attempts, "wait", wait)
+			reasons = append(reasons, fmt.Sprintf("Failed to process addon %s: %s", addon.Name, retry.LastError))
+			requeue = sooner(requeue, wait)
+			continue
+		}
+
+		err := r.validateAndProcessAddon(ctx, instance, addon, process)
+		if pending(err) {
+			l.V(logLevelDebug).Info("Waiting for addon", "addon", addon.Name, "reason", err.Error())
+			waiting = true
+			requeue = sooner(requeue, pollInterval)
+			continue
+		}
+		if err != nil {
+			l.Error(err, "Failed to process addon", "addon", addon.Name)
+			reasons = append(reasons, fmt.Sprintf("Failed to process addon %s: %v", addon.Name, err))
+			requeue = sooner(requeue, r.recordFailure(instance, addon, err, time.Now()))
+			continue
+		}
+		addonStatus(instance, addon.Name).Retry = nil
+	}
+
+	if len(reasons) == 0 {
+		if !waiting {
+			return 0, false
+		}
+		instance.Status.StatusCode = managev1.CAddonStatusPending
+		instance.Status.ReasonOfFailure = ""
+		return requeue, true
+	}
+	instance.Status.StatusCode = managev1.CAddonStatusFailure
+	instance.Status.ReasonOfFailure = strings.Join(reasons, "; ")
+	return requeue, true
+}
+
 func (r *ClusterAddonReconciler) validateAndProcessAddon(
 	ctx context.Context,
+	instance *managev1.ClusterAddon,
 	addon managev1.Addon,
-	process func(ctx context.Context, addonName string, addonVer *string) error,
+	process func(ctx context.Context, instance *managev1.ClusterAddon, addon managev1.Addon) error,
 ) error {
 
-	if _, present := addonManifests[addon.Name]; !present {
+	manifest, present := addonManifests[addon.Name]
+	if !present {
 		return fmt.Errorf("unsupported addon: %s", addon.Name)
 	}
 
-	return process(ctx, addon.Name, addon.Version)
+	l := log.FromContext(ctx).WithValues("addon", addon.Name)
+
+	status := addonStatus(instance, addon.Name)
+	status.Suspended = instance.Spec.Suspend || addon.Suspended
+	if status.Suspended {
+		l.Info("Skipping suspended addon")
+		return nil
+	}
+
+	ctx, err := r.withAddonClient(log.IntoContext(ctx, l), manifest, addon)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := r.startSpan(ctx, "processAddon", attribute.String("addon", addon.Name))
+	err = process(ctx, instance, addon)
+	endSpan(span, err)
+	return err
+}
+
+// addonStatus returns the status entry of the addon, adding it if missing.
+func addonStatus(instance *managev1.ClusterAddon, addonName string) *managev1.AddonStatus {
+	for i := range instance.Status.Addons {
+		if instance.Status.Addons[i].Name == addonName {
+			return &instance.Status.Addons[i]
+		}
+	}
+
+	instance.Status.Addons = append(instance.Status.Addons, managev1.AddonStatus{Name: addonName})
+	return &instance.Status.Addons[len(instance.Status.Addons)-1]
+}
+
+// hasSuspendedAddons reports whether the spec suspends any addon, the status
+// may still list addons which were removed from the spec since.
+func hasSuspendedAddons(instance *managev1.ClusterAddon) bool {
+	if instance.Spec.Suspend {
+		return true
+	}
+	return slices.ContainsFunc(instance.Spec.Addons, func(a managev1.Addon) bool { return a.Suspended })
+}
+
+// pruneAddonStatus drops the status entries of addons no longer in the spec.
+func pruneAddonStatus(instance *managev1.ClusterAddon) {
+	instance.Status.Addons = slices.DeleteFunc(instance.Status.Addons, func(s managev1.AddonStatus) bool {
+		return !slices.ContainsFunc(instance.Spec.Addons, func(a managev1.Addon) bool { return a.Name == s.Name })
+	})
+}
+
+func (r *ClusterAddonReconciler) updateStatus(ctx context.Context, instance *managev1.ClusterAddon) (err error) {
+	ctx, span := r.startSpan(ctx, "updateStatus", attribute.String("status", string(instance.Status.StatusCode)))
+	defer func() { endSpan(span, err) }()
+
+	return r.Status().Update(ctx, instance)
+}
+
+// stateStore returns State, defaulting it once to the ConfigMap store: the
+// reconciles share the store, which serializes their updates.
+func (r *ClusterAddonReconciler) stateStore() StateStore {
+	r.stateOnce.Do(func() {
+		if r.State == nil {
+			r.State = NewConfigMapStateStore(r.Client)
+		}
+	})
+	return r.State
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ClusterAddonReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&managev1.ClusterAddon{}).
+	// Status updates, kcm's own included, do not change the generation and
+	// need no reconcile. Deletion does, for objects with finalizers.
+	c, err := ctrl.NewControllerManagedBy(mgr).
+		For(&managev1.ClusterAddon{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Named("clusteraddon").
-		Complete(r)
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: r.MaxConcurrentReconciles,
+			RateLimiter:             r.RateLimiter,
+		}).
+		Build(r)
+	if err != nil {
+		return err
+	}
+
+	if !r.WatchAddonObjects {
+		return nil
+	}
+
+	// The objects of addons are watched as their kinds get installed, through
+	// a cache of their own which only holds objects kcm labelled
+	mapper := r.RESTMapper
+	if mapper == nil {
+		mapper = mgr.GetRESTMapper()
+	}
+	objectCache, err := cache.New(mgr.GetConfig(), cache.Options{
+		Scheme:               mgr.GetScheme(),
+		Mapper:               mapper,
+		DefaultLabelSelector: addonObjectSelector(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create the cache of addon objects: %w", err)
+	}
+	if err := mgr.Add(objectCache); err != nil {
+		return err
+	}
+
+	r.controller, r.objectCache = c, objectCache
+	return nil
 }
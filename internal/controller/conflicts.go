@@ -0,0 +1,219 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/structured-merge-diff/v4/fieldpath"
+	"sigs.k8s.io/structured-merge-diff/v4/value"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// the api server reports the manager of a conflicting field as
+// `conflict with "kubectl-edit" using apps/v1`
+var conflictManager = regexp.MustCompile(`conflict with "([^"]*)"`)
+
+// conflictResolver applies the conflict policy of an addon and collects the
+// conflicts it ran into.
+type conflictResolver struct {
+	policy   managev1.ConflictPolicy
+	managers []string
+
+	mu        sync.Mutex
+	conflicts []managev1.FieldConflict
+}
+
+func newConflictResolver(addon managev1.Addon) *conflictResolver {
+	policy := addon.ConflictPolicy
+	if policy == "" {
+		policy = managev1.ConflictPolicyForce
+	}
+	return &conflictResolver{policy: policy, managers: addon.SkipManagers}
+}
+
+// resolution returns how the conflict with manager is resolved.
+func (c *conflictResolver) resolution(manager string) managev1.ConflictPolicy {
+	if c.policy == managev1.ConflictPolicySkip && !slices.Contains(c.managers, manager) {
+		return managev1.ConflictPolicyForce
+	}
+	return c.policy
+}
+
+func (c *conflictResolver) record(conflicts []managev1.FieldConflict) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conflicts = append(c.conflicts, conflicts...)
+}
+
+// Conflicts returns the conflicts recorded so far.
+func (c *conflictResolver) Conflicts() []managev1.FieldConflict {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.conflicts)
+}
+
+// resolve handles the conflicts server-side apply reported for obj, it
+// returns the object to apply again with force, or nil if the addon has to
+// fail instead.
+func (c *conflictResolver) resolve(obj, live *unstructured.Unstructured, conflicts []managev1.FieldConflict) (*unstructured.Unstructured, error) {
+	fail := false
+	for i := range conflicts {
+		conflicts[i].Resolution = c.resolution(conflicts[i].Manager)
+		fail = fail || conflicts[i].Resolution == managev1.ConflictPolicyFail
+	}
+	c.record(conflicts)
+
+	if fail {
+		return nil, nil
+	}
+	if c.policy != managev1.ConflictPolicySkip {
+		return obj, nil
+	}
+
+	stripped := obj.DeepCopy()
+	if err := removeManagedFields(stripped, live, c.managers); err != nil {
+		return nil, err
+	}
+	return stripped, nil
+}
+
+// fieldConflicts returns the conflicts server-side apply reported in err.
+func fieldConflicts(obj *unstructured.Unstructured, err error) []managev1.FieldConflict {
+	var status apierrors.APIStatus
+	if !apierrors.IsConflict(err) || !errors.As(err, &status) || status.Status().Details == nil {
+		return nil
+	}
+
+	var conflicts []managev1.FieldConflict
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type != metav1.CauseTypeFieldManagerConflict {
+			continue
+		}
+		conflict := managev1.FieldConflict{
+			ObjectReference: objectReference(obj),
+			Field:           cause.Field,
+		}
+		if m := conflictManager.FindStringSubmatch(cause.Message); m != nil {
+			conflict.Manager = m[1]
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts
+}
+
+// applyConflicting applies obj again after server-side apply reported
+// conflicts for it, according to the conflict policy.
+func (r *ClusterAddonReconciler) applyConflicting(
+	ctx context.Context,
+	obj *unstructured.Unstructured,
+	resolver *conflictResolver,
+	conflicts []managev1.FieldConflict,
+	applyErr error,
+) (*unstructured.Unstructured, error) {
+	var live *unstructured.Unstructured
+	if resolver.policy == managev1.ConflictPolicySkip {
+		dr, err := r.resourceInterface(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		if live, err = dr.Get(ctx, obj.GetName(), metav1.GetOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to get live resource: %w", err)
+		}
+	}
+
+	forced, err := resolver.resolve(obj, live, conflicts)
+	if err != nil {
+		return nil, err
+	}
+	if forced == nil {
+		return nil, fmt.Errorf("conflicting field managers: %w", applyErr)
+	}
+	return forced, nil
+}
+
+// removeManagedFields removes the fields the live object records as owned
+// by one of managers from obj.
+func removeManagedFields(obj, live *unstructured.Unstructured, managers []string) error {
+	for _, entry := range live.GetManagedFields() {
+		if !slices.Contains(managers, entry.Manager) || entry.FieldsV1 == nil {
+			continue
+		}
+
+		set := &fieldpath.Set{}
+		if err := set.FromJSON(bytes.NewReader(entry.FieldsV1.Raw)); err != nil {
+			return fmt.Errorf("failed to decode fields of %s: %w", entry.Manager, err)
+		}
+		set.Leaves().Iterate(func(p fieldpath.Path) {
+			obj.Object = removePath(obj.Object, p).(map[string]interface{})
+		})
+	}
+	return nil
+}
+
+// removePath returns v without the value at p.
+func removePath(v interface{}, p fieldpath.Path) interface{} {
+	if len(p) == 0 {
+		return v
+	}
+	pe := p[0]
+
+	switch c := v.(type) {
+	case map[string]interface{}:
+		if pe.FieldName == nil {
+			return v
+		}
+		child, ok := c[*pe.FieldName]
+		if !ok {
+			return v
+		}
+		if len(p) == 1 {
+			delete(c, *pe.FieldName)
+		} else {
+			c[*pe.FieldName] = removePath(child, p[1:])
+		}
+		return c
+	case []interface{}:
+		for i, item := range c {
+			if !matchesElement(pe, i, item) {
+				continue
+			}
+			if len(p) == 1 {
+				return append(c[:i:i], c[i+1:]...)
+			}
+			c[i] = removePath(item, p[1:])
+			return c
+		}
+	}
+	return v
+}
+
+func matchesElement(pe fieldpath.PathElement, i int, item interface{}) bool {
+	switch {
+	case pe.Index != nil:
+		return *pe.Index == i
+	case pe.Value != nil:
+		return value.Equals(*pe.Value, value.NewValueInterface(item))
+	case pe.Key != nil:
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for _, f := range *pe.Key {
+			field, ok := m[f.Name]
+			if !ok || !value.Equals(f.Value, value.NewValueInterface(field)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
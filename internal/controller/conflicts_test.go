@@ -0,0 +1,73 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Field manager conflicts", func() {
+	deployment := func() *unstructured.Unstructured {
+		obj := newObject("apps/v1", "Deployment", "ka", "web")
+		Expect(unstructured.SetNestedField(obj.Object, int64(1), "spec", "replicas")).To(Succeed())
+		Expect(unstructured.SetNestedSlice(obj.Object, []interface{}{
+			map[string]interface{}{"name": "web", "image": "nginx:1.0"},
+			map[string]interface{}{"name": "proxy", "image": "envoy:1.0"},
+		}, "spec", "template", "spec", "containers")).To(Succeed())
+		return obj
+	}
+
+	It("parses the conflicts reported by server-side apply", func() {
+		obj := deployment()
+		err := apierrors.NewApplyConflict([]metav1.StatusCause{
+			{Type: metav1.CauseTypeFieldManagerConflict, Message: `conflict with "kubectl-edit" using apps/v1`, Field: ".spec.replicas"},
+		}, "Apply failed with 1 conflict")
+
+		Expect(fieldConflicts(obj, err)).To(Equal([]managev1.FieldConflict{{
+			ObjectReference: objectReference(obj),
+			Manager:         "kubectl-edit",
+			Field:           ".spec.replicas",
+		}}))
+		Expect(fieldConflicts(obj, apierrors.NewConflict(schema.GroupResource{}, "web", nil))).To(BeEmpty())
+	})
+
+	It("resolves conflicts according to the policy", func() {
+		skip := newConflictResolver(managev1.Addon{ConflictPolicy: managev1.ConflictPolicySkip, SkipManagers: []string{"hpa"}})
+		Expect(skip.resolution("hpa")).To(Equal(managev1.ConflictPolicySkip))
+		Expect(skip.resolution("kubectl-edit")).To(Equal(managev1.ConflictPolicyForce))
+
+		fail := newConflictResolver(managev1.Addon{ConflictPolicy: managev1.ConflictPolicyFail})
+		forced, err := fail.resolve(deployment(), nil, []managev1.FieldConflict{{Manager: "kubectl-edit"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(forced).To(BeNil())
+		Expect(fail.Conflicts()).To(ConsistOf(HaveField("Resolution", managev1.ConflictPolicyFail)))
+
+		Expect(newConflictResolver(managev1.Addon{}).policy).To(Equal(managev1.ConflictPolicyForce))
+	})
+
+	It("leaves the fields of skipped managers out of the applied object", func() {
+		live := deployment()
+		live.SetManagedFields([]metav1.ManagedFieldsEntry{
+			{Manager: "hpa", FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{}}}`)}},
+			{Manager: "kubectl-edit", FieldsV1: &metav1.FieldsV1{
+				Raw: []byte(`{"f:spec":{"f:template":{"f:spec":{"f:containers":{"k:{\"name\":\"proxy\"}":{".":{},"f:image":{}}}}}}}`),
+			}},
+		})
+
+		obj := deployment()
+		Expect(removeManagedFields(obj, live, []string{"hpa", "kubectl-edit"})).To(Succeed())
+
+		_, found, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "replicas")
+		Expect(found).To(BeFalse())
+		containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+		Expect(containers).To(Equal([]interface{}{
+			map[string]interface{}{"name": "web", "image": "nginx:1.0"},
+			map[string]interface{}{"name": "proxy"},
+		}))
+	})
+})
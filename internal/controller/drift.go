@@ -0,0 +1,271 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// addonObjectSelector selects the objects kcm applied, the cache of addon
+// objects only holds those.
+func addonObjectSelector() labels.Selector {
+	owner, err := labels.NewRequirement(LabelOwner, selection.Exists, nil)
+	if err != nil {
+		panic(err)
+	}
+	addon, err := labels.NewRequirement(LabelAddon, selection.Exists, nil)
+	if err != nil {
+		panic(err)
+	}
+	return labels.NewSelector().Add(*owner, *addon)
+}
+
+// driftTracker remembers which addons may have drifted from their manifest:
+// those whose objects were changed by someone else and those not checked
+// since kcm started.
+type driftTracker struct {
+	mu      sync.Mutex
+	checked map[string]struct{}
+}
+
+func driftKey(owner, addonName string) string {
+	return owner + "/" + labelValue(addonName)
+}
+
+func (d *driftTracker) drifted(owner, addonName string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.checked[driftKey(owner, addonName)]
+	return !ok
+}
+
+func (d *driftTracker) setChecked(owner, addonName string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.checked == nil {
+		d.checked = map[string]struct{}{}
+	}
+	d.checked[driftKey(owner, addonName)] = struct{}{}
+}
+
+func (d *driftTracker) setDrifted(owner, addonName string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.checked, driftKey(owner, addonName))
+}
+
+// addonObjectPredicate passes the changes to addon objects which may make
+// them drift from the manifest: deletions and updates by other field
+// managers of anything but the status. Creations are kcm's own or replay the
+// objects already there when a watch starts.
+var addonObjectPredicate = predicate.Funcs{
+	CreateFunc:  func(event.CreateEvent) bool { return false },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+	DeleteFunc:  func(event.DeleteEvent) bool { return true },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		if e.ObjectOld.GetResourceVersion() == e.ObjectNew.GetResourceVersion() {
+			return false
+		}
+		return desiredStateChanged(e.ObjectOld, e.ObjectNew) && lastManager(e.ObjectNew) != fieldManager
+	},
+}
+
+// desiredStateChanged reports whether an update changed more than the status
+// of an object and what Kubernetes itself keeps up to date in its metadata.
+func desiredStateChanged(old, updated client.Object) bool {
+	if !maps.Equal(old.GetLabels(), updated.GetLabels()) ||
+		!maps.Equal(userAnnotations(old), userAnnotations(updated)) {
+		return true
+	}
+	if updated.GetGeneration() > 0 {
+		return old.GetGeneration() != updated.GetGeneration()
+	}
+
+	// Kinds without a generation, such as ConfigMaps, have no status either
+	o, ok := old.(*unstructured.Unstructured)
+	u, ok2 := updated.(*unstructured.Unstructured)
+	if !ok || !ok2 {
+		return true
+	}
+	return !equality.Semantic.DeepEqual(withoutMetadata(o), withoutMetadata(u))
+}
+
+// userAnnotations drops the annotations of the Kubernetes domains, such as
+// deployment.kubernetes.io/revision, which controllers update as they go.
+func userAnnotations(obj client.Object) map[string]string {
+	a := maps.Clone(obj.GetAnnotations())
+	maps.DeleteFunc(a, func(k, _ string) bool {
+		prefix, _, found := strings.Cut(k, "/")
+		return found && (prefix == "kubernetes.io" || strings.HasSuffix(prefix, ".kubernetes.io") ||
+			prefix == "k8s.io" || strings.HasSuffix(prefix, ".k8s.io"))
+	})
+	return a
+}
+
+func withoutMetadata(obj *unstructured.Unstructured) map[string]interface{} {
+	content := maps.Clone(obj.Object)
+	delete(content, "metadata")
+	delete(content, "status")
+	return content
+}
+
+// lastManager returns the field manager which updated obj last, other than
+// through the status subresource.
+func lastManager(obj client.Object) string {
+	var last *metav1.ManagedFieldsEntry
+	for i, entry := range obj.GetManagedFields() {
+		if entry.Time == nil || entry.Subresource == "status" {
+			continue
+		}
+		if last == nil || !entry.Time.Before(last.Time) {
+			last = &obj.GetManagedFields()[i]
+		}
+	}
+	if last == nil {
+		return ""
+	}
+	return last.Manager
+}
+
+// enqueueOwner marks the addon the changed object belongs to as drifted and
+// enqueues the ClusterAddon which installed it.
+func (r *ClusterAddonReconciler) enqueueOwner(_ context.Context, obj client.Object) []reconcile.Request {
+	owner, addonName := obj.GetAnnotations()[AnnotationOwner], obj.GetLabels()[LabelAddon]
+	if owner == "" || addonName == "" {
+		return nil
+	}
+	r.drift.setDrifted(owner, addonName)
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: owner}}}
+}
+
+// watchInventory starts watching the kinds of the objects in inventory, so
+// changes to them trigger a reconcile of their owner.
+func (r *ClusterAddonReconciler) watchInventory(ctx context.Context, inventory []managev1.ObjectReference) error {
+	if r.controller == nil || r.objectCache == nil {
+		return nil
+	}
+
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+
+	if r.watched == nil {
+		r.watched = map[schema.GroupVersionKind]struct{}{}
+	}
+	for _, ref := range inventory {
+		gvk := schema.FromAPIVersionAndKind(ref.APIVersion, ref.Kind)
+		if _, ok := r.watched[gvk]; ok {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gvk)
+		src := source.Kind[client.Object](r.objectCache, obj, handler.EnqueueRequestsFromMapFunc(r.enqueueOwner), addonObjectPredicate)
+		if err := r.controller.Watch(src); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", gvk, err)
+		}
+		r.watched[gvk] = struct{}{}
+		log.FromContext(ctx).Info("Watching addon objects", "kind", gvk.String())
+	}
+	return nil
+}
+
+// checkInstalled keeps the installed version of the addon as it was applied,
+// correcting drift when kcm watches its objects.
+func (r *ClusterAddonReconciler) checkInstalled(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addon managev1.Addon,
+	manifest AddonManifest,
+	state *managev1.AddonState,
+) error {
+	if !r.WatchAddonObjects {
+		// Changes to the objects of the addon go unnoticed without watches
+		r.drift.setChecked(instance.Name, addon.Name)
+		return nil
+	}
+
+	if err := r.watchInventory(ctx, state.Inventory); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to watch objects of addon")
+	}
+	if r.drift.drifted(instance.Name, addon.Name) {
+		return r.correctDrift(ctx, instance, addon, manifest, state)
+	}
+	return nil
+}
+
+// correctDrift applies the installed version of the addon again, reverting
+// whatever was changed or deleted since it was applied.
+func (r *ClusterAddonReconciler) correctDrift(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addon managev1.Addon,
+	manifest AddonManifest,
+	state *managev1.AddonState,
+) error {
+	// The objects are applied as they were, without reaching the release
+	objs, err := r.installedManifest(ctx, instance, addon, manifest, state)
+	if err != nil {
+		return fmt.Errorf("failed to check addon %s for drift: %w", addon.Name, err)
+	}
+
+	// An object drifted if applying it changed it
+	var corrected atomic.Int32
+	resolver := newConflictResolver(addon)
+	apply := func(ctx context.Context, obj *unstructured.Unstructured) error {
+		dr, err := r.resourceInterface(ctx, obj)
+		if err != nil {
+			return err
+		}
+		var before string
+		live, err := dr.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if err == nil {
+			before = live.GetResourceVersion()
+		} else if !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to get live resource: %w", err)
+		}
+
+		applied, err := r.applyObject(ctx, obj, resolver)
+		if err != nil {
+			return err
+		}
+		if applied.GetResourceVersion() != before {
+			objectLogger(ctx, obj).Info("Reverted drift of resource")
+			corrected.Add(1)
+		}
+		return nil
+	}
+
+	err = r.applyStaged(ctx, objs, apply, true)
+	addonStatus(instance, addon.Name).Conflicts = resolver.Conflicts()
+	if n := corrected.Load(); n > 0 {
+		driftCorrectionsTotal.WithLabelValues(addon.Name).Add(float64(n))
+		r.event(instance, EventReasonDriftCorrected, "Reverted changes to %d objects of addon %s %s", n, addon.Name, state.Version)
+	}
+	if err != nil {
+		r.warning(instance, EventReasonApplyFailed, "Failed to apply addon %s %s: %v", addon.Name, state.Version, err)
+		return fmt.Errorf("failed to correct drift of addon %s: %w", addon.Name, err)
+	}
+
+	r.drift.setChecked(instance.Name, addon.Name)
+	return nil
+}
@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Addon drift", func() {
+	instance := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "drift"}}
+
+	updatedBy := func(manager, resourceVersion string) client.Object {
+		obj := newObject("v1", "ConfigMap", "ka", "cfg")
+		obj.SetResourceVersion(resourceVersion)
+		obj.SetManagedFields([]metav1.ManagedFieldsEntry{
+			{Manager: fieldManager, Time: &metav1.Time{Time: time.Now().Add(-time.Minute)}},
+			{Manager: manager, Time: &metav1.Time{Time: time.Now()}},
+		})
+		return obj
+	}
+
+	It("only selects the objects kcm applied", func() {
+		Expect(addonObjectSelector().Matches(labels.Set(ownerLabels(instance, "stack")))).To(BeTrue())
+		Expect(addonObjectSelector().Matches(labels.Set{LabelAddon: "stack"})).To(BeFalse())
+	})
+
+	It("passes changes made by others", func() {
+		old := updatedBy(fieldManager, "1")
+		edited := func(manager string) client.Object {
+			obj := updatedBy(manager, "2").(*unstructured.Unstructured)
+			obj.Object["data"] = map[string]interface{}{"key": "edited"}
+			return obj
+		}
+		Expect(addonObjectPredicate.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: edited("kubectl-edit")})).To(BeTrue())
+		Expect(addonObjectPredicate.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: edited(fieldManager)})).To(BeFalse())
+		Expect(addonObjectPredicate.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updatedBy("kubectl-edit", "2")})).To(BeFalse())
+		Expect(addonObjectPredicate.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: old})).To(BeFalse())
+		Expect(addonObjectPredicate.Delete(event.DeleteEvent{Object: old})).To(BeTrue())
+		Expect(addonObjectPredicate.Create(event.CreateEvent{Object: old})).To(BeFalse())
+	})
+
+	It("ignores status updates and what controllers keep up to date", func() {
+		deployment := func(resourceVersion string, generation int64) *unstructured.Unstructured {
+			obj := newObject("apps/v1", "Deployment", "ka", "web")
+			obj.SetResourceVersion(resourceVersion)
+			obj.SetGeneration(generation)
+			return obj
+		}
+
+		old := deployment("1", 1)
+		rolledOut := deployment("2", 1)
+		rolledOut.Object["status"] = map[string]interface{}{"readyReplicas": int64(2)}
+		rolledOut.SetAnnotations(map[string]string{"deployment.kubernetes.io/revision": "2"})
+		rolledOut.SetManagedFields([]metav1.ManagedFieldsEntry{
+			{Manager: fieldManager, Time: &metav1.Time{Time: time.Now().Add(-time.Minute)}},
+			{Manager: "kube-controller-manager", Subresource: "status", Time: &metav1.Time{Time: time.Now()}},
+		})
+		Expect(addonObjectPredicate.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: rolledOut})).To(BeFalse())
+
+		scaled := deployment("3", 2)
+		scaled.SetManagedFields([]metav1.ManagedFieldsEntry{
+			{Manager: fieldManager, Time: &metav1.Time{Time: time.Now().Add(-time.Minute)}},
+			{Manager: "kubectl-scale", Time: &metav1.Time{Time: time.Now().Add(-time.Second)}},
+			{Manager: "kube-controller-manager", Subresource: "status", Time: &metav1.Time{Time: time.Now()}},
+		})
+		Expect(addonObjectPredicate.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: scaled})).To(BeTrue())
+	})
+
+	It("marks the addon drifted and enqueues its owner", func() {
+		r := &ClusterAddonReconciler{}
+		Expect(r.drift.drifted(instance.Name, "stack")).To(BeTrue())
+		r.drift.setChecked(instance.Name, "stack")
+		Expect(r.drift.drifted(instance.Name, "stack")).To(BeFalse())
+
+		obj := newObject("v1", "ConfigMap", "ka", "cfg")
+		stampObjects([]*unstructured.Unstructured{obj}, instance, managev1.Addon{Name: "stack"}, "v0.1.0")
+		Expect(r.enqueueOwner(context.Background(), obj)).To(Equal([]reconcile.Request{
+			{NamespacedName: client.ObjectKey{Name: "drift"}},
+		}))
+		Expect(r.drift.drifted(instance.Name, "stack")).To(BeTrue())
+
+		// Label values are shortened to 63 characters, the owner is read from its annotation
+		long := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: strings.Repeat("platform-", 10)}}
+		r.drift.setChecked(long.Name, "stack")
+		stampObjects([]*unstructured.Unstructured{obj}, long, managev1.Addon{Name: "stack"}, "v0.1.0")
+		Expect(r.enqueueOwner(context.Background(), obj)).To(Equal([]reconcile.Request{
+			{NamespacedName: client.ObjectKey{Name: long.Name}},
+		}))
+		Expect(r.drift.drifted(long.Name, "stack")).To(BeTrue())
+
+		Expect(r.enqueueOwner(context.Background(), newObject("v1", "ConfigMap", "ka", "other"))).To(BeEmpty())
+	})
+
+	It("corrects drift from the applied manifest without downloading it", func() {
+		ctx := context.Background()
+		var gone atomic.Bool
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if gone.Load() {
+				http.NotFound(w, req)
+				return
+			}
+			_, _ = w.Write([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cfg\n  namespace: ka\ndata:\n  release: one\n"))
+		}))
+		defer srv.Close()
+		manifest := AddonManifest{URL: func(version string) string { return srv.URL + "/" + version }}
+		addonManifests["drifting"] = manifest
+		defer delete(addonManifests, "drifting")
+
+		gv := schema.GroupVersion{Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+		var applies atomic.Int32
+		dc := applyingDynamicClient(&applies)
+		store := NewMemoryStateStore()
+		r := &ClusterAddonReconciler{Client: newFakeClient(), RESTMapper: mapper, DynamicClient: dc, State: store}
+
+		addon := managev1.Addon{Name: "drifting", Version: ptr.To("v0.1.0")}
+		Expect(r.HandleAddon(ctx, instance, addon)).To(Succeed())
+
+		// The release went away and someone deleted the object
+		gone.Store(true)
+		configMaps := dc.Resource(gv.WithResource("configmaps")).Namespace("ka")
+		Expect(configMaps.Delete(ctx, "cfg", metav1.DeleteOptions{})).To(Succeed())
+
+		state, err := store.Get(ctx, instance, "drifting")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.correctDrift(ctx, instance, addon, manifest, state)).To(Succeed())
+
+		cfg, err := configMaps.Get(ctx, "cfg", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Object["data"]).To(Equal(map[string]interface{}{"release": "one"}))
+	})
+})
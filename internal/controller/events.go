@@ -0,0 +1,60 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// Reasons of the events recorded on a ClusterAddon.
+const (
+	EventReasonInstallStarted          = "InstallStarted"
+	EventReasonInstalled               = "Installed"
+	EventReasonUpgradeStarted          = "UpgradeStarted"
+	EventReasonUpgraded                = "Upgraded"
+	EventReasonReapplied               = "Reapplied"
+	EventReasonUninstallStarted        = "UninstallStarted"
+	EventReasonUninstalled             = "Uninstalled"
+	EventReasonOrphaned                = "Orphaned"
+	EventReasonVersionResolutionFailed = "VersionResolutionFailed"
+	EventReasonDownloadFailed          = "DownloadFailed"
+	EventReasonApplyFailed             = "ApplyFailed"
+	EventReasonDeleteFailed            = "DeleteFailed"
+	EventReasonPolicyViolation         = "PolicyViolation"
+	EventReasonFieldConflict           = "FieldConflict"
+	EventReasonNamespaceRetained       = "NamespaceRetained"
+	EventReasonHookFailed              = "HookFailed"
+	EventReasonNotReady                = "NotReady"
+	EventReasonRollbackStarted         = "RollbackStarted"
+	EventReasonRolledBack              = "RolledBack"
+	EventReasonRollbackFailed          = "RollbackFailed"
+	EventReasonRetriesExhausted        = "RetriesExhausted"
+	EventReasonDriftCorrected          = "DriftCorrected"
+)
+
+func (r *ClusterAddonReconciler) event(instance *managev1.ClusterAddon, reason, messageFmt string, args ...interface{}) {
+	r.recordEvent(instance, corev1.EventTypeNormal, reason, messageFmt, args...)
+}
+
+// announcer returns the function recording that an operation on the addon
+// started. Operations waiting for a hook Job were announced when they started.
+func (r *ClusterAddonReconciler) announcer(
+	instance *managev1.ClusterAddon,
+	addonName, version string,
+) func(instance *managev1.ClusterAddon, reason, messageFmt string, args ...interface{}) {
+	if hooksRunning(instance, addonName, version) {
+		return func(*managev1.ClusterAddon, string, string, ...interface{}) {}
+	}
+	return r.event
+}
+
+func (r *ClusterAddonReconciler) warning(instance *managev1.ClusterAddon, reason, messageFmt string, args ...interface{}) {
+	r.recordEvent(instance, corev1.EventTypeWarning, reason, messageFmt, args...)
+}
+
+func (r *ClusterAddonReconciler) recordEvent(instance *managev1.ClusterAddon, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(instance, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,275 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+const (
+	defaultRevisionHistoryLimit = 10
+
+	manifestKey = "manifest"
+)
+
+func revisionHistoryLimit(addon managev1.Addon) int {
+	if addon.RevisionHistoryLimit == nil || *addon.RevisionHistoryLimit < 1 {
+		return defaultRevisionHistoryLimit
+	}
+	return int(*addon.RevisionHistoryLimit)
+}
+
+// manifestDigest returns the sha256 of objs as they are applied.
+func manifestDigest(objs []*unstructured.Unstructured) (string, error) {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, obj := range objs {
+		if err := enc.Encode(obj.Object); err != nil {
+			return "", err
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// encodeManifest returns objs as they are kept for the installed version of
+// the addon.
+func encodeManifest(objs []*unstructured.Unstructured) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(objs); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeManifest returns the objects kept for the installed version of the
+// addon.
+func decodeManifest(raw []byte) ([]*unstructured.Unstructured, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = zr.Close() }()
+
+	var objs []*unstructured.Unstructured
+	if err := json.NewDecoder(zr).Decode(&objs); err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+// installedManifest returns the objects applied for the installed version of
+// the addon. They are rendered again when kcm did not keep them, or the kept
+// ones belong to another revision.
+func (r *ClusterAddonReconciler) installedManifest(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addon managev1.Addon,
+	manifest AddonManifest,
+	state *managev1.AddonState,
+) ([]*unstructured.Unstructured, error) {
+	objs, err := r.storedManifest(ctx, addon.Name)
+	if err != nil {
+		return nil, err
+	}
+	if objs != nil {
+		digest, err := manifestDigest(objs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to digest manifest: %w", err)
+		}
+		if rev := currentRevision(state); rev == nil || rev.Digest == digest {
+			return objs, nil
+		}
+		log.FromContext(ctx).Info("Kept manifest does not match the installed revision, rendering it again", "revision", state.Revision)
+	}
+
+	objs, err = r.renderManifest(ctx, instance, addon, manifest, state.Version)
+	if err != nil {
+		return nil, err
+	}
+	objs, _, err = splitHooks(objs)
+	return objs, err
+}
+
+// manifestSecretName is the Secret keeping the objects applied for the
+// installed version of an addon, apart from its state: they may be large
+// and may hold Secrets themselves.
+func manifestSecretName(addonName string) string {
+	return "kcm-manifest-" + addonName
+}
+
+// storeManifest keeps objs as the objects applied for the installed version
+// of the addon.
+func (r *ClusterAddonReconciler) storeManifest(ctx context.Context, addonName string, objs []*unstructured.Unstructured) error {
+	raw, err := encodeManifest(objs)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: stateNamespace, Name: manifestSecretName(addonName)}
+	if err := r.Get(ctx, key, secret); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+			Data:       map[string][]byte{manifestKey: raw},
+		}
+		return r.Create(ctx, secret)
+	}
+	secret.Data = map[string][]byte{manifestKey: raw}
+	return r.Update(ctx, secret)
+}
+
+// storedManifest returns the objects kept for the installed version of the
+// addon, nil if there are none.
+func (r *ClusterAddonReconciler) storedManifest(ctx context.Context, addonName string) ([]*unstructured.Unstructured, error) {
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: stateNamespace, Name: manifestSecretName(addonName)}
+	if err := r.Get(ctx, key, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	objs, err := decodeManifest(secret.Data[manifestKey])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode manifest of addon %s: %w", addonName, err)
+	}
+	return objs, nil
+}
+
+// forgetManifest drops the objects kept for an addon kcm no longer manages.
+func (r *ClusterAddonReconciler) forgetManifest(ctx context.Context, addonName string) error {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: stateNamespace, Name: manifestSecretName(addonName)}}
+	return client.IgnoreNotFound(r.Delete(ctx, secret))
+}
+
+// newRevision returns the revision recording an attempt to apply objs as
+// version of the addon, numbered after the latest revision in state.
+func newRevision(
+	instance *managev1.ClusterAddon,
+	addon managev1.Addon,
+	state *managev1.AddonState,
+	version string,
+	objs []*unstructured.Unstructured,
+	result managev1.AddonRevisionResult,
+) (managev1.AddonRevision, error) {
+	digest, err := manifestDigest(objs)
+	if err != nil {
+		return managev1.AddonRevision{}, fmt.Errorf("failed to digest manifest: %w", err)
+	}
+
+	rev := managev1.AddonRevision{
+		Revision:   1,
+		Version:    version,
+		Digest:     digest,
+		AppliedAt:  metav1.Now(),
+		Result:     result,
+		Generation: instance.Generation,
+	}
+	if state != nil {
+		rev.Revision = max(rev.Revision, state.Revision+1)
+		if n := len(state.History); n > 0 {
+			rev.Revision = max(rev.Revision, state.History[n-1].Revision+1)
+		}
+	}
+	if addon.RollbackTo != nil {
+		rev.RollbackOf = *addon.RollbackTo
+	}
+	return rev, nil
+}
+
+// appendRevision appends rev to history, dropping the oldest revisions
+// beyond limit.
+func appendRevision(history []managev1.AddonRevision, rev managev1.AddonRevision, limit int) []managev1.AddonRevision {
+	history = append(history, rev)
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	return history
+}
+
+// currentRevision returns the revision of the installed version of the addon,
+// or nil if it was installed before kcm kept a history.
+func currentRevision(state *managev1.AddonState) *managev1.AddonRevision {
+	for i := range state.History {
+		if state.History[i].Revision == state.Revision {
+			return &state.History[i]
+		}
+	}
+	return nil
+}
+
+// keepRevision records that the installed revision of the addon stands for
+// the current generation of the ClusterAddon, whose changes left the manifest
+// as it was.
+func (r *ClusterAddonReconciler) keepRevision(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addon managev1.Addon,
+	manifest AddonManifest,
+	state *managev1.AddonState,
+) error {
+	updated := *state
+	updated.History = slices.Clone(state.History)
+	currentRevision(&updated).Generation = instance.Generation
+	if err := r.stateStore().Set(ctx, instance, addon.Name, updated); err != nil {
+		return err
+	}
+	return r.checkInstalled(ctx, instance, addon, manifest, &updated)
+}
+
+// revisionVersion returns the version a rollback to revision installs.
+func revisionVersion(state *managev1.AddonState, revision int64) (string, error) {
+	if state == nil {
+		return "", fmt.Errorf("cannot roll back to revision %d, the addon is not installed", revision)
+	}
+	// Rolling back appends a revision, which evicts the target from a full
+	// history
+	if rev := currentRevision(state); rev != nil && rev.RollbackOf == revision {
+		return state.Version, nil
+	}
+	for _, rev := range state.History {
+		if rev.Revision != revision {
+			continue
+		}
+		if rev.Result != managev1.AddonRevisionSucceeded {
+			return "", fmt.Errorf("cannot roll back to revision %d, it did not succeed", revision)
+		}
+		return rev.Version, nil
+	}
+	return "", fmt.Errorf("revision %d is not in the history of the addon", revision)
+}
+
+// recordFailedRevision adds a failed upgrade to the history of the installed
+// version of the addon.
+func (r *ClusterAddonReconciler) recordFailedRevision(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addon managev1.Addon,
+	state *managev1.AddonState,
+	rev managev1.AddonRevision,
+) error {
+	updated := *state
+	updated.History = appendRevision(state.History, rev, revisionHistoryLimit(addon))
+	return r.stateStore().Set(ctx, instance, addon.Name, updated)
+}
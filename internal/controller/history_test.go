@@ -0,0 +1,62 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/ptr"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Addon revision history", func() {
+	instance := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "history", Generation: 4}}
+
+	It("numbers revisions and keeps a bounded history", func() {
+		objs := []*unstructured.Unstructured{newObject("v1", "ConfigMap", "ka", "cfg")}
+
+		first, err := newRevision(instance, managev1.Addon{}, nil, "v0.1.0", objs, managev1.AddonRevisionSucceeded)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(first.Revision).To(Equal(int64(1)))
+		Expect(first.Generation).To(Equal(int64(4)))
+		Expect(first.Digest).To(HavePrefix("sha256:"))
+
+		state := &managev1.AddonState{Version: "v0.1.0", Revision: 1, History: []managev1.AddonRevision{first}}
+		failed, err := newRevision(instance, managev1.Addon{}, state, "v0.2.0", objs, managev1.AddonRevisionFailed)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(failed.Revision).To(Equal(int64(2)))
+		state.History = append(state.History, failed)
+
+		rollback, err := newRevision(instance, managev1.Addon{RollbackTo: ptr.To[int64](1)}, state, "v0.1.0", objs,
+			managev1.AddonRevisionSucceeded)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rollback.Revision).To(Equal(int64(3)))
+		Expect(rollback.RollbackOf).To(Equal(int64(1)))
+		Expect(rollback.Digest).To(Equal(first.Digest))
+
+		history := appendRevision(state.History, rollback, 2)
+		Expect(history).To(HaveLen(2))
+		Expect(history[0].Revision).To(Equal(int64(2)))
+		Expect(history[1].Revision).To(Equal(int64(3)))
+
+		Expect(revisionHistoryLimit(managev1.Addon{})).To(Equal(defaultRevisionHistoryLimit))
+		Expect(revisionHistoryLimit(managev1.Addon{RevisionHistoryLimit: ptr.To[int32](3)})).To(Equal(3))
+	})
+
+	It("rolls back to succeeded revisions only", func() {
+		state := &managev1.AddonState{History: []managev1.AddonRevision{
+			{Revision: 1, Version: "v0.1.0", Result: managev1.AddonRevisionSucceeded},
+			{Revision: 2, Version: "v0.2.0", Result: managev1.AddonRevisionRolledBack},
+		}}
+
+		Expect(revisionVersion(state, 1)).To(Equal("v0.1.0"))
+
+		_, err := revisionVersion(state, 2)
+		Expect(err).To(MatchError(ContainSubstring("did not succeed")))
+		_, err = revisionVersion(state, 7)
+		Expect(err).To(MatchError(ContainSubstring("not in the history")))
+		_, err = revisionVersion(nil, 1)
+		Expect(err).To(MatchError(ContainSubstring("not installed")))
+	})
+})
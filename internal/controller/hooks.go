@@ -0,0 +1,352 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+const (
+	// AnnotationHook marks a Job of an addon manifest as a hook, its value is
+	// a comma separated list of the hook types it runs at.
+	AnnotationHook = "manage.ksctl.com/hook"
+	// AnnotationHookTimeout bounds how long a hook Job may run, e.g. 10m.
+	AnnotationHookTimeout = "manage.ksctl.com/hook-timeout"
+
+	defaultHookTimeout = 5 * time.Minute
+)
+
+// pollInterval is how often the Jobs of running hooks and the workloads of
+// addons rolling out are checked.
+var pollInterval = 5 * time.Second
+
+var hookTypes = []managev1.HookType{
+	managev1.HookTypePreInstall,
+	managev1.HookTypePostInstall,
+	managev1.HookTypePreDelete,
+	managev1.HookTypePostUpgrade,
+}
+
+var jobKind = schema.GroupKind{Group: "batch", Kind: "Job"}
+
+// splitHooks separates the hook Jobs of a manifest from the objects which
+// are applied as part of the addon.
+func splitHooks(objs []*unstructured.Unstructured) (regular, hooks []*unstructured.Unstructured, err error) {
+	for _, obj := range objs {
+		types, ok := obj.GetAnnotations()[AnnotationHook]
+		if !ok {
+			regular = append(regular, obj)
+			continue
+		}
+
+		if obj.GroupVersionKind().GroupKind() != jobKind {
+			return nil, nil, fmt.Errorf("hook %s %s/%s must be a Job", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+		}
+		for _, t := range strings.Split(types, ",") {
+			if !slices.Contains(hookTypes, managev1.HookType(strings.TrimSpace(t))) {
+				return nil, nil, fmt.Errorf("hook Job %s/%s has unknown hook type %q", obj.GetNamespace(), obj.GetName(), t)
+			}
+		}
+		hooks = append(hooks, obj)
+	}
+	return regular, hooks, nil
+}
+
+// hooksOf returns the hooks which run at the given lifecycle step.
+func hooksOf(hooks []*unstructured.Unstructured, hookType managev1.HookType) []*unstructured.Unstructured {
+	var matching []*unstructured.Unstructured
+	for _, obj := range hooks {
+		for _, t := range strings.Split(obj.GetAnnotations()[AnnotationHook], ",") {
+			if managev1.HookType(strings.TrimSpace(t)) == hookType {
+				matching = append(matching, obj)
+				break
+			}
+		}
+	}
+	return matching
+}
+
+// errHookRunning is returned while a hook Job runs, the addon is processed
+// again once it had time to complete rather than blocking the reconcile.
+var errHookRunning = errors.New("waiting for hook Job to complete")
+
+// pending reports whether err says the addon waits for a hook Job or its
+// workloads, it is checked on again after pollInterval.
+func pending(err error) bool {
+	return errors.Is(err, errHookRunning) || errors.Is(err, errNotReady)
+}
+
+// runHooks runs the hooks of the lifecycle step one after the other, in
+// manifest order, and records their progress in the addon status. Each call
+// starts or checks the first hook which has not succeeded for version yet,
+// returning errHookRunning until all of them did. In dry-run mode the hooks
+// are only added to the plan.
+func (r *ClusterAddonReconciler) runHooks(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addonName, version string,
+	plan *managev1.AddonPlan,
+	hooks []*unstructured.Unstructured,
+	hookType managev1.HookType,
+) error {
+	for _, job := range hooksOf(hooks, hookType) {
+		if plan != nil {
+			plan.Hooks = append(plan.Hooks, objectReference(job))
+			continue
+		}
+
+		status := addonStatus(instance, addonName)
+		hs := hookStatus(status, job.GetName(), hookType)
+		if hs == nil || hs.Version != version || hs.Phase == managev1.HookPhaseFailed {
+			started, err := r.startHook(ctx, job)
+			if err != nil {
+				return r.hookFailed(instance, addonName, version, job, hookType, err)
+			}
+			if started {
+				setHookStatus(status, managev1.HookStatus{
+					Name:      job.GetName(),
+					Namespace: job.GetNamespace(),
+					Type:      hookType,
+					Version:   version,
+					Phase:     managev1.HookPhaseRunning,
+					StartedAt: metav1.Now(),
+				})
+			}
+			return errHookRunning
+		}
+		if hs.Phase == managev1.HookPhaseSucceeded {
+			continue
+		}
+
+		done, err := r.checkHook(ctx, job, hs.StartedAt.Time)
+		if err != nil {
+			return r.hookFailed(instance, addonName, version, job, hookType, err)
+		}
+		if !done {
+			return errHookRunning
+		}
+		hs.Phase = managev1.HookPhaseSucceeded
+		hs.CompletedAt = ptr.To(metav1.Now())
+		objectLogger(ctx, job).Info("Hook completed")
+	}
+	return nil
+}
+
+// hookFailed records the failure of a hook and returns the error failing the
+// addon with it.
+func (r *ClusterAddonReconciler) hookFailed(
+	instance *managev1.ClusterAddon,
+	addonName, version string,
+	job *unstructured.Unstructured,
+	hookType managev1.HookType,
+	err error,
+) error {
+	status := addonStatus(instance, addonName)
+	hs := managev1.HookStatus{
+		Name:        job.GetName(),
+		Namespace:   job.GetNamespace(),
+		Type:        hookType,
+		Version:     version,
+		Phase:       managev1.HookPhaseFailed,
+		StartedAt:   metav1.Now(),
+		CompletedAt: ptr.To(metav1.Now()),
+		Message:     err.Error(),
+	}
+	if prev := hookStatus(status, job.GetName(), hookType); prev != nil && prev.Phase == managev1.HookPhaseRunning {
+		hs.StartedAt = prev.StartedAt
+	}
+	setHookStatus(status, hs)
+
+	r.warning(instance, EventReasonHookFailed, "Hook %s %s of addon %s %s failed: %v", hookType, job.GetName(), addonName, version, err)
+	return fmt.Errorf("%s hook %s failed: %w", hookType, job.GetName(), err)
+}
+
+// hooksRunning reports whether a hook Job of the addon started for version is
+// running, the operation it belongs to is then resumed rather than started.
+// Only hooks of the given types are considered, or all of them if none are
+// given.
+func hooksRunning(instance *managev1.ClusterAddon, addonName, version string, types ...managev1.HookType) bool {
+	for _, a := range instance.Status.Addons {
+		if a.Name != addonName {
+			continue
+		}
+		return slices.ContainsFunc(a.Hooks, func(hs managev1.HookStatus) bool {
+			return hs.Phase == managev1.HookPhaseRunning && hs.Version == version &&
+				(len(types) == 0 || slices.Contains(types, hs.Type))
+		})
+	}
+	return false
+}
+
+// runPreDeleteHooks runs the pre-delete hooks of the installed version, which
+// are only known from its manifest.
+func (r *ClusterAddonReconciler) runPreDeleteHooks(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addon managev1.Addon,
+	manifest AddonManifest,
+	version string,
+	plan *managev1.AddonPlan,
+) error {
+	objs, err := r.renderManifest(ctx, instance, addon, manifest, version)
+	if err != nil {
+		return err
+	}
+
+	_, hooks, err := splitHooks(objs)
+	if err != nil {
+		return err
+	}
+	return r.runHooks(ctx, instance, addon.Name, version, plan, hooks, managev1.HookTypePreDelete)
+}
+
+// startHook replaces the Job of a previous run with a new one. It reports
+// false while the previous Job is still running or being deleted, a run is
+// never cut short, e.g. a migration of the previous version.
+func (r *ClusterAddonReconciler) startHook(ctx context.Context, job *unstructured.Unstructured) (bool, error) {
+	if _, err := hookTimeout(job); err != nil {
+		return false, err
+	}
+
+	dr, err := r.resourceInterface(ctx, job)
+	if err != nil {
+		return false, err
+	}
+
+	prev, err := dr.Get(ctx, job.GetName(), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("failed to get previous run: %w", err)
+	}
+	if err == nil {
+		if done, _ := jobFinished(prev); !done && prev.GetDeletionTimestamp() == nil {
+			objectLogger(ctx, job).Info("Waiting for previous run of hook to finish")
+			return false, nil
+		}
+		if err := r.deleteHook(ctx, job); err != nil {
+			return false, fmt.Errorf("failed to delete previous run: %w", err)
+		}
+		if _, err := dr.Get(ctx, job.GetName(), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			if err != nil {
+				return false, fmt.Errorf("failed to get previous run: %w", err)
+			}
+			objectLogger(ctx, job).V(logLevelDebug).Info("Waiting for previous run of hook to be deleted")
+			return false, nil
+		}
+	}
+
+	objectLogger(ctx, job).Info("Running hook")
+	if _, err := dr.Create(ctx, job, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		return false, fmt.Errorf("failed to create hook Job: %w", err)
+	}
+	return true, nil
+}
+
+// checkHook reports whether the Job of a hook started at startedAt has
+// completed, it fails once the Job failed or ran out of time.
+func (r *ClusterAddonReconciler) checkHook(ctx context.Context, job *unstructured.Unstructured, startedAt time.Time) (bool, error) {
+	timeout, err := hookTimeout(job)
+	if err != nil {
+		return false, err
+	}
+
+	dr, err := r.resourceInterface(ctx, job)
+	if err != nil {
+		return false, err
+	}
+	live, err := dr.Get(ctx, job.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get hook Job: %w", err)
+	}
+
+	done, failure := jobFinished(live)
+	if failure != "" {
+		return false, fmt.Errorf("%s", failure)
+	}
+	if !done && time.Since(startedAt) > timeout {
+		// The Job is stopped, its next run would otherwise wait for it
+		if err := r.deleteHook(ctx, job); err != nil {
+			objectLogger(ctx, job).Error(err, "Failed to stop hook Job")
+		}
+		return false, fmt.Errorf("hook Job did not complete within %s", timeout)
+	}
+	return done, nil
+}
+
+// deleteHook deletes the Job of a hook along with its Pods.
+func (r *ClusterAddonReconciler) deleteHook(ctx context.Context, job *unstructured.Unstructured) error {
+	dr, err := r.resourceInterface(ctx, job)
+	if err != nil {
+		return err
+	}
+	background := metav1.DeletePropagationBackground
+	if err := dr.Delete(ctx, job.GetName(), metav1.DeleteOptions{PropagationPolicy: &background}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func hookTimeout(job *unstructured.Unstructured) (time.Duration, error) {
+	v, ok := job.GetAnnotations()[AnnotationHookTimeout]
+	if !ok {
+		return defaultHookTimeout, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s annotation: %w", AnnotationHookTimeout, err)
+	}
+	return d, nil
+}
+
+// hookStatus returns the status of the last run of the hook, nil if it
+// never ran.
+func hookStatus(status *managev1.AddonStatus, name string, hookType managev1.HookType) *managev1.HookStatus {
+	for i := range status.Hooks {
+		if status.Hooks[i].Name == name && status.Hooks[i].Type == hookType {
+			return &status.Hooks[i]
+		}
+	}
+	return nil
+}
+
+// jobFinished reports whether the Job has finished, and why it failed if so.
+func jobFinished(job *unstructured.Unstructured) (bool, string) {
+	conditions, _, _ := unstructured.NestedSlice(job.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if !ok || cond["status"] != "True" {
+			continue
+		}
+		switch cond["type"] {
+		case "Complete":
+			return true, ""
+		case "Failed":
+			msg, _ := cond["message"].(string)
+			if msg == "" {
+				msg, _ = cond["reason"].(string)
+			}
+			return true, "Job failed: " + msg
+		}
+	}
+	return false, ""
+}
+
+func setHookStatus(status *managev1.AddonStatus, hs managev1.HookStatus) {
+	for i := range status.Hooks {
+		if status.Hooks[i].Name == hs.Name && status.Hooks[i].Type == hs.Type {
+			status.Hooks[i] = hs
+			return
+		}
+	}
+	status.Hooks = append(status.Hooks, hs)
+}
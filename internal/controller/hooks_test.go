@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Addon hooks", func() {
+	ctx := context.Background()
+
+	hookJob := func(name, types, condition string) *unstructured.Unstructured {
+		job := newObject("batch/v1", "Job", "ka", name)
+		job.SetAnnotations(map[string]string{AnnotationHook: types, AnnotationHookTimeout: "1s"})
+		if condition != "" {
+			Expect(unstructured.SetNestedSlice(job.Object, []interface{}{
+				map[string]interface{}{"type": condition, "status": "True", "message": "BackoffLimitExceeded"},
+			}, "status", "conditions")).To(Succeed())
+		}
+		return job
+	}
+
+	It("separates hook Jobs from the addon objects", func() {
+		cfg := newObject("v1", "ConfigMap", "ka", "cfg")
+		migrate := hookJob("migrate", "pre-install, post-upgrade", "")
+
+		regular, hooks, err := splitHooks([]*unstructured.Unstructured{cfg, migrate})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(regular).To(Equal([]*unstructured.Unstructured{cfg}))
+		Expect(hooksOf(hooks, managev1.HookTypePostUpgrade)).To(Equal([]*unstructured.Unstructured{migrate}))
+		Expect(hooksOf(hooks, managev1.HookTypePostInstall)).To(BeEmpty())
+
+		cfg.SetAnnotations(map[string]string{AnnotationHook: "pre-install"})
+		_, _, err = splitHooks([]*unstructured.Unstructured{cfg})
+		Expect(err).To(MatchError(ContainSubstring("must be a Job")))
+
+		_, _, err = splitHooks([]*unstructured.Unstructured{hookJob("typo", "pre-instal", "")})
+		Expect(err).To(MatchError(ContainSubstring("unknown hook type")))
+	})
+
+	It("starts hook Jobs and checks on them in later calls", func() {
+		gv := schema.GroupVersion{Group: "batch", Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("Job"), meta.RESTScopeNamespace)
+		dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{gv.WithResource("jobs"): "JobList"},
+			hookJob("smoke", "post-install", "Failed"))
+		jobs := dc.Resource(gv.WithResource("jobs")).Namespace("ka")
+		finish := func(name, condition string) {
+			Expect(jobs.Update(ctx, hookJob(name, "post-install", condition), metav1.UpdateOptions{})).Error().NotTo(HaveOccurred())
+		}
+		r := &ClusterAddonReconciler{RESTMapper: mapper, DynamicClient: dc}
+		instance := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "hooks", Generation: 1}}
+		status := addonStatus(instance, "stack")
+		run := func(hooks ...*unstructured.Unstructured) error {
+			return r.runHooks(ctx, instance, "stack", "v0.1.0", nil, hooks, managev1.HookTypePostInstall)
+		}
+
+		// The Job of the previous run is replaced
+		smoke, broken := hookJob("smoke", "post-install", ""), hookJob("broken", "post-install", "")
+		Expect(run(smoke, broken)).To(MatchError(errHookRunning))
+		live, err := jobs.Get(ctx, "smoke", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(live.Object).NotTo(HaveKey("status"))
+		Expect(status.Hooks).To(HaveLen(1))
+		Expect(status.Hooks[0].Phase).To(Equal(managev1.HookPhaseRunning))
+		Expect(hooksRunning(instance, "stack", "v0.1.0")).To(BeTrue())
+
+		Expect(run(smoke, broken)).To(MatchError(errHookRunning))
+		finish("smoke", "Complete")
+		Expect(run(smoke, broken)).To(MatchError(errHookRunning))
+		Expect(status.Hooks).To(HaveLen(2))
+		Expect(status.Hooks[0].Phase).To(Equal(managev1.HookPhaseSucceeded))
+		Expect(status.Hooks[1].Phase).To(Equal(managev1.HookPhaseRunning))
+
+		finish("broken", "Failed")
+		Expect(run(smoke, broken)).To(MatchError(ContainSubstring("BackoffLimitExceeded")))
+		Expect(status.Hooks[1].Phase).To(Equal(managev1.HookPhaseFailed))
+		Expect(hooksRunning(instance, "stack", "v0.1.0")).To(BeFalse())
+
+		// Failed hooks run again, until they run out of time
+		Expect(run(smoke, broken)).To(MatchError(errHookRunning))
+		Expect(status.Hooks[1].Phase).To(Equal(managev1.HookPhaseRunning))
+		status.Hooks[1].StartedAt = metav1.NewTime(time.Now().Add(-time.Minute))
+		Expect(run(smoke, broken)).To(MatchError(ContainSubstring("did not complete within 1s")))
+		_, err = jobs.Get(ctx, "broken", metav1.GetOptions{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		// A run of the previous version is left to finish
+		migrate := hookJob("migrate", "post-install", "")
+		Expect(jobs.Create(ctx, migrate, metav1.CreateOptions{})).Error().NotTo(HaveOccurred())
+		setHookStatus(status, managev1.HookStatus{
+			Name: "migrate", Type: managev1.HookTypePostInstall, Version: "v0.0.9", Phase: managev1.HookPhaseRunning,
+		})
+		Expect(run(migrate)).To(MatchError(errHookRunning))
+		Expect(hookStatus(status, "migrate", managev1.HookTypePostInstall).Version).To(Equal("v0.0.9"))
+		finish("migrate", "Complete")
+		Expect(run(migrate)).To(MatchError(errHookRunning))
+		Expect(hookStatus(status, "migrate", managev1.HookTypePostInstall).Version).To(Equal("v0.1.0"))
+
+		plan := &managev1.AddonPlan{}
+		Expect(r.runHooks(ctx, instance, "stack", "v0.1.0", plan, []*unstructured.Unstructured{smoke, broken}, managev1.HookTypePostInstall)).To(Succeed())
+		Expect(plan.Hooks).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// podSpecPaths is where the pod template lives in the workloads whose images
+// are rewritten.
+var podSpecPaths = map[schema.GroupKind][]string{
+	{Kind: "Pod"}:                        {"spec"},
+	{Group: "apps", Kind: "Deployment"}:  {"spec", "template", "spec"},
+	{Group: "apps", Kind: "StatefulSet"}: {"spec", "template", "spec"},
+	{Group: "apps", Kind: "DaemonSet"}:   {"spec", "template", "spec"},
+	{Group: "batch", Kind: "Job"}:        {"spec", "template", "spec"},
+	{Group: "batch", Kind: "CronJob"}:    {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+var containerFields = []string{"initContainers", "containers", "ephemeralContainers"}
+
+// imageRewrite merges the rewrite of the addon with the global one of the
+// ClusterAddon, the addon's rules and digests take precedence.
+func imageRewrite(instance *managev1.ClusterAddon, addon managev1.Addon) managev1.ImageRewrite {
+	var merged managev1.ImageRewrite
+	for _, rw := range []*managev1.ImageRewrite{instance.Spec.ImageRewrite, addon.ImageRewrite} {
+		if rw == nil {
+			continue
+		}
+		merged.Rules = append(append([]managev1.ImageRewriteRule(nil), rw.Rules...), merged.Rules...)
+		for ref, digest := range rw.Digests {
+			if merged.Digests == nil {
+				merged.Digests = map[string]string{}
+			}
+			merged.Digests[ref] = digest
+		}
+	}
+	return merged
+}
+
+// rewriteImages rewrites the container images of the workloads among objs in
+// place.
+func rewriteImages(objs []*unstructured.Unstructured, rw managev1.ImageRewrite) error {
+	if len(rw.Rules) == 0 && len(rw.Digests) == 0 {
+		return nil
+	}
+
+	for _, obj := range objs {
+		path, ok := podSpecPaths[obj.GroupVersionKind().GroupKind()]
+		if !ok {
+			continue
+		}
+
+		for _, field := range containerFields {
+			fields := append(append([]string(nil), path...), field)
+			containers, found, err := unstructured.NestedSlice(obj.Object, fields...)
+			if err != nil || !found {
+				continue
+			}
+
+			for _, c := range containers {
+				container, ok := c.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if image, ok := container["image"].(string); ok {
+					container["image"] = rewriteImage(image, rw)
+				}
+			}
+
+			if err := unstructured.SetNestedSlice(obj.Object, containers, fields...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteImage applies the first matching rule and then pins the digest, an
+// image nothing applies to is returned unchanged.
+func rewriteImage(image string, rw managev1.ImageRewrite) string {
+	qualified := qualifyImage(image)
+	rewritten := image
+
+	for _, rule := range rw.Rules {
+		if strings.HasPrefix(qualified, rule.Prefix) {
+			rewritten = rule.Replacement + strings.TrimPrefix(qualified, rule.Prefix)
+			break
+		}
+	}
+
+	digest, ok := imageDigest(rw.Digests, rewritten)
+	if !ok {
+		return rewritten
+	}
+	if i := strings.Index(rewritten, "@"); i >= 0 {
+		rewritten = rewritten[:i]
+	} else if i := strings.LastIndex(rewritten, ":"); i > strings.LastIndex(rewritten, "/") {
+		rewritten = rewritten[:i]
+	}
+	return rewritten + "@" + digest
+}
+
+// imageDigest returns the digest image is pinned to. References are compared
+// fully qualified, so nginx:1.27 and docker.io/library/nginx:1.27 pin the
+// same image.
+func imageDigest(digests map[string]string, image string) (string, bool) {
+	if digest, ok := digests[image]; ok {
+		return digest, true
+	}
+	qualified := qualifyImage(image)
+	for ref, digest := range digests {
+		if qualifyImage(ref) == qualified {
+			return digest, true
+		}
+	}
+	return "", false
+}
+
+// qualifyImage returns the image reference with the registry and, for
+// Docker Hub, the library namespace the container runtime would assume.
+func qualifyImage(image string) string {
+	first, rest, found := strings.Cut(image, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return image
+	}
+	if !found {
+		return "docker.io/library/" + image
+	}
+	return "docker.io/" + first + "/" + rest
+}
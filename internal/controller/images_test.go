@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Image rewriting", func() {
+	rw := managev1.ImageRewrite{
+		Rules: []managev1.ImageRewriteRule{
+			{Prefix: "ghcr.io/ksctl/", Replacement: "mirror.local/ksctl/"},
+			{Prefix: "docker.io/", Replacement: "mirror.local/hub/"},
+		},
+		Digests: map[string]string{
+			"mirror.local/ksctl/ka:v0.1.0":          "sha256:abc",
+			"quay.io/prometheus/node-exporter:v1.8": "sha256:def",
+		},
+	}
+
+	DescribeTable("rewrites image references",
+		func(image, expected string) {
+			Expect(rewriteImage(image, rw)).To(Equal(expected))
+		},
+		Entry("registry prefix", "ghcr.io/ksctl/agent:v1", "mirror.local/ksctl/agent:v1"),
+		Entry("docker hub library", "nginx:1.27", "mirror.local/hub/library/nginx:1.27"),
+		Entry("docker hub user", "bitnami/redis:7", "mirror.local/hub/bitnami/redis:7"),
+		Entry("digest pinning", "ghcr.io/ksctl/ka:v0.1.0", "mirror.local/ksctl/ka@sha256:abc"),
+		Entry("no match", "quay.io/prometheus/node-exporter:v1", "quay.io/prometheus/node-exporter:v1"),
+		Entry("registry with port", "localhost:5000/app:v1", "localhost:5000/app:v1"),
+		Entry("digest pinning without a rule", "quay.io/prometheus/node-exporter:v1.8", "quay.io/prometheus/node-exporter@sha256:def"),
+	)
+
+	It("pins digests of images no rule applies to by their qualified reference", func() {
+		digests := managev1.ImageRewrite{Digests: map[string]string{"docker.io/library/busybox:1.36": "sha256:123"}}
+		Expect(rewriteImage("busybox:1.36", digests)).To(Equal("busybox@sha256:123"))
+
+		digests = managev1.ImageRewrite{Digests: map[string]string{"busybox:1.36": "sha256:123"}}
+		Expect(rewriteImage("docker.io/library/busybox:1.36", digests)).To(Equal("docker.io/library/busybox@sha256:123"))
+	})
+
+	It("rewrites the containers of workloads", func() {
+		cron := newObject("batch/v1", "CronJob", "ka", "backup")
+		path := []string{"spec", "jobTemplate", "spec", "template", "spec"}
+		Expect(unstructured.SetNestedSlice(cron.Object, []interface{}{
+			map[string]interface{}{"name": "init", "image": "busybox"},
+		}, append(path, "initContainers")...)).To(Succeed())
+		Expect(unstructured.SetNestedSlice(cron.Object, []interface{}{
+			map[string]interface{}{"name": "backup", "image": "ghcr.io/ksctl/ka:v0.1.0"},
+		}, append(path, "containers")...)).To(Succeed())
+		cfg := newObject("v1", "ConfigMap", "ka", "cfg")
+		cfg.Object["data"] = map[string]interface{}{"image": "nginx"}
+
+		Expect(rewriteImages([]*unstructured.Unstructured{cron, cfg}, rw)).To(Succeed())
+
+		initContainers, _, _ := unstructured.NestedSlice(cron.Object, append(path, "initContainers")...)
+		Expect(initContainers[0]).To(HaveKeyWithValue("image", "mirror.local/hub/library/busybox"))
+		containers, _, _ := unstructured.NestedSlice(cron.Object, append(path, "containers")...)
+		Expect(containers[0]).To(HaveKeyWithValue("image", "mirror.local/ksctl/ka@sha256:abc"))
+		Expect(cfg.Object["data"]).To(HaveKeyWithValue("image", "nginx"))
+	})
+
+	It("prefers the rules of the addon over the global ones", func() {
+		instance := &managev1.ClusterAddon{Spec: managev1.ClusterAddonSpec{ImageRewrite: &rw}}
+		addon := managev1.Addon{Name: "stack", ImageRewrite: &managev1.ImageRewrite{
+			Rules: []managev1.ImageRewriteRule{{Prefix: "ghcr.io/", Replacement: "other.local/"}},
+		}}
+
+		Expect(rewriteImage("ghcr.io/ksctl/agent:v1", imageRewrite(instance, addon))).To(Equal("other.local/ksctl/agent:v1"))
+		Expect(rewriteImage("nginx", imageRewrite(instance, addon))).To(Equal("mirror.local/hub/library/nginx"))
+	})
+
+	It("rewrites the images of an installed addon once the rules change", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("apiVersion: v1\nkind: Pod\nmetadata:\n  name: agent\n  namespace: ka\n" +
+				"spec:\n  containers:\n  - name: agent\n    image: ghcr.io/ksctl/agent:v1\n"))
+		}))
+		defer srv.Close()
+		addonManifests["rewritten"] = AddonManifest{URL: func(string) string { return srv.URL }}
+		defer delete(addonManifests, "rewritten")
+
+		gv := schema.GroupVersion{Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("Pod"), meta.RESTScopeNamespace)
+		var applies atomic.Int32
+		dc := applyingDynamicClient(&applies)
+		store := NewMemoryStateStore()
+		r := &ClusterAddonReconciler{Client: newFakeClient(), RESTMapper: mapper, DynamicClient: dc, State: store}
+
+		ctx := context.Background()
+		instance := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "rewritten", Generation: 1}}
+		addon := managev1.Addon{Name: "rewritten", Version: ptr.To("v0.1.0")}
+		Expect(r.HandleAddon(ctx, instance, addon)).To(Succeed())
+
+		instance.Spec.ImageRewrite = &managev1.ImageRewrite{
+			Rules: []managev1.ImageRewriteRule{{Prefix: "ghcr.io/", Replacement: "mirror.local/"}},
+		}
+		instance.Generation++
+		Expect(r.HandleAddon(ctx, instance, addon)).To(Succeed())
+
+		pod, err := dc.Resource(gv.WithResource("pods")).Namespace("ka").Get(ctx, "agent", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		containers, _, _ := unstructured.NestedSlice(pod.Object, "spec", "containers")
+		Expect(containers[0]).To(HaveKeyWithValue("image", "mirror.local/ksctl/agent:v1"))
+
+		// Changes which leave the objects as they are apply nothing
+		applied := applies.Load()
+		instance.Generation++
+		Expect(r.HandleAddon(ctx, instance, addon)).To(Succeed())
+		Expect(applies.Load()).To(Equal(applied))
+
+		state, err := store.Get(ctx, instance, "rewritten")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state.History).To(HaveLen(2))
+		Expect(currentRevision(state).Generation).To(Equal(instance.Generation))
+	})
+})
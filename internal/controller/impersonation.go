@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// addonServiceAccountNamespace is where the ServiceAccounts impersonated for
+// addons live, next to kcm itself.
+const addonServiceAccountNamespace = stateNamespace
+
+type addonClientKey struct{}
+
+// withAddonClient returns ctx carrying the dynamic client the addon's objects
+// are applied and deleted with. Without impersonation ctx is returned as is
+// and kcm's own client is used.
+func (r *ClusterAddonReconciler) withAddonClient(ctx context.Context, manifest AddonManifest, addon managev1.Addon) (context.Context, error) {
+	if !r.ImpersonateAddonServiceAccounts {
+		return ctx, nil
+	}
+
+	// Only the addon definition picks the ServiceAccount, anyone able to
+	// create a ClusterAddon could otherwise borrow any in kcm-system
+	sa := manifest.ServiceAccount
+	if sa == "" {
+		return nil, fmt.Errorf("addon %s declares no ServiceAccount to impersonate", addon.Name)
+	}
+
+	dc, err := r.impersonatingClient(fmt.Sprintf("system:serviceaccount:%s:%s", addonServiceAccountNamespace, sa))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client impersonating %s: %w", sa, err)
+	}
+	return context.WithValue(ctx, addonClientKey{}, dc), nil
+}
+
+func (r *ClusterAddonReconciler) impersonatingClient(username string) (dynamic.Interface, error) {
+	r.clientsMu.Lock()
+	defer r.clientsMu.Unlock()
+
+	if dc, ok := r.clients[username]; ok {
+		return dc, nil
+	}
+
+	if r.RestConfig == nil {
+		return nil, fmt.Errorf("impersonation requires a rest config")
+	}
+	cfg := rest.CopyConfig(r.RestConfig)
+	cfg.Impersonate = rest.ImpersonationConfig{UserName: username}
+
+	dc, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.clients == nil {
+		r.clients = map[string]dynamic.Interface{}
+	}
+	r.clients[username] = dc
+	return dc, nil
+}
+
+// dynamicClient returns the client for the addon being processed in ctx.
+func (r *ClusterAddonReconciler) dynamicClient(ctx context.Context) dynamic.Interface {
+	if dc, ok := ctx.Value(addonClientKey{}).(dynamic.Interface); ok {
+		return dc
+	}
+	return r.DynamicClient
+}
@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/rest"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Impersonation", func() {
+	ctx := context.Background()
+	manifest := AddonManifest{ServiceAccount: "kcm-addon-stack"}
+
+	It("uses kcm's own client unless enabled", func() {
+		r := &ClusterAddonReconciler{}
+		actx, err := r.withAddonClient(ctx, manifest, managev1.Addon{Name: "stack"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(actx.Value(addonClientKey{})).To(BeNil())
+	})
+
+	It("impersonates the ServiceAccount of the addon definition", func() {
+		r := &ClusterAddonReconciler{ImpersonateAddonServiceAccounts: true, RestConfig: &rest.Config{Host: "https://127.0.0.1"}}
+
+		_, err := r.withAddonClient(ctx, manifest, managev1.Addon{Name: "stack"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.clients).To(HaveLen(1))
+		Expect(r.clients).To(HaveKey("system:serviceaccount:kcm-system:kcm-addon-stack"))
+	})
+
+	It("fails for addons without a ServiceAccount", func() {
+		r := &ClusterAddonReconciler{ImpersonateAddonServiceAccounts: true, RestConfig: &rest.Config{}}
+		_, err := r.withAddonClient(ctx, AddonManifest{}, managev1.Addon{Name: "stack"})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// Labels kcm stamps every object it applies with.
+const (
+	LabelAddon   = "manage.ksctl.com/addon"
+	LabelVersion = "manage.ksctl.com/version"
+	LabelOwner   = "manage.ksctl.com/owner"
+)
+
+// AnnotationOwner holds the full name of the ClusterAddon which applied an
+// object, LabelOwner is shortened to the length label values are limited to.
+const AnnotationOwner = "manage.ksctl.com/owner"
+
+// labelHashLength is the length of the hash ending shortened label values.
+const labelHashLength = 10
+
+// stampObjects adds the kcm labels and the extra labels and annotations of
+// the spec to objs in place.
+func stampObjects(objs []*unstructured.Unstructured, instance *managev1.ClusterAddon, addon managev1.Addon, version string) {
+	extraLabels := map[string]string{}
+	maps.Copy(extraLabels, instance.Spec.Labels)
+	maps.Copy(extraLabels, addon.Labels)
+
+	extraAnnotations := map[string]string{}
+	maps.Copy(extraAnnotations, instance.Spec.Annotations)
+	maps.Copy(extraAnnotations, addon.Annotations)
+
+	for _, obj := range objs {
+		l := obj.GetLabels()
+		if l == nil {
+			l = map[string]string{}
+		}
+		maps.Copy(l, extraLabels)
+		maps.Copy(l, ownerLabels(instance, addon.Name))
+		l[LabelVersion] = labelValue(version)
+		obj.SetLabels(l)
+
+		a := obj.GetAnnotations()
+		if a == nil {
+			a = map[string]string{}
+		}
+		maps.Copy(a, extraAnnotations)
+		a[AnnotationOwner] = instance.Name
+		obj.SetAnnotations(a)
+	}
+}
+
+// ownerLabels select the objects kcm applied for the addon on behalf of the
+// ClusterAddon.
+func ownerLabels(instance *managev1.ClusterAddon, addonName string) map[string]string {
+	return map[string]string{
+		LabelAddon: labelValue(addonName),
+		LabelOwner: labelValue(instance.Name),
+	}
+}
+
+// labelValue turns s into a valid label value, versions such as
+// v1.0.0+build are not. Values too long for a label keep a prefix and end in
+// a hash of s, names sharing the prefix select different objects.
+func labelValue(s string) string {
+	if len(validation.IsValidLabelValue(s)) == 0 {
+		return s
+	}
+	value := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+	if len(value) > validation.LabelValueMaxLength {
+		sum := sha256.Sum256([]byte(s))
+		hash := hex.EncodeToString(sum[:])[:labelHashLength]
+		value = strings.TrimRight(value[:validation.LabelValueMaxLength-labelHashLength-1], "-_.") + "-" + hash
+	}
+	return strings.Trim(value, "-_.")
+}
+
+func inventory(objs []*unstructured.Unstructured) []managev1.ObjectReference {
+	refs := make([]managev1.ObjectReference, 0, len(objs))
+	for _, obj := range objs {
+		refs = append(refs, objectReference(obj))
+	}
+	return refs
+}
+
+// installedObjects returns the objects kcm applied for the installed version
+// of the addon: those of the inventory recorded in its state and any other
+// object of the same kinds carrying the addon's labels. Installations which
+// predate the inventory fall back to the manifest of the installed version.
+func (r *ClusterAddonReconciler) installedObjects(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addonName string,
+	manifest AddonManifest,
+	state *managev1.AddonState,
+) ([]*unstructured.Unstructured, error) {
+	if len(state.Inventory) == 0 {
+		return r.downloadManifest(ctx, addonName, manifest, state.Version)
+	}
+
+	var objs []*unstructured.Unstructured
+	seen := map[managev1.ObjectReference]struct{}{}
+	add := func(obj *unstructured.Unstructured) {
+		if _, ok := seen[objectKey(obj)]; !ok {
+			seen[objectKey(obj)] = struct{}{}
+			objs = append(objs, obj)
+		}
+	}
+
+	var kinds []managev1.ObjectReference
+	for _, ref := range state.Inventory {
+		add(newReferencedObject(ref))
+		kind := managev1.ObjectReference{APIVersion: ref.APIVersion, Kind: ref.Kind}
+		if !slices.Contains(kinds, kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	selector := labels.SelectorFromSet(ownerLabels(instance, addonName)).String()
+	for _, kind := range kinds {
+		dr, err := r.resourceInterface(ctx, newReferencedObject(kind))
+		if err != nil {
+			return nil, err
+		}
+
+		list, err := dr.List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s of addon %s: %w", kind.Kind, addonName, err)
+		}
+		for i := range list.Items {
+			// downloadManifest defaults the namespace of every object, cluster
+			// scoped ones included, do the same so keys match those of manifests
+			if list.Items[i].GetNamespace() == "" && manifest.Namespace != nil {
+				list.Items[i].SetNamespace(*manifest.Namespace)
+			}
+			add(&list.Items[i])
+		}
+	}
+	return objs, nil
+}
+
+func newReferencedObject(ref managev1.ObjectReference) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(ref.APIVersion)
+	obj.SetKind(ref.Kind)
+	obj.SetNamespace(ref.Namespace)
+	obj.SetName(ref.Name)
+	return obj
+}
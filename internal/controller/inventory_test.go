@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Inventory", func() {
+	ctx := context.Background()
+	instance := &managev1.ClusterAddon{
+		ObjectMeta: metav1.ObjectMeta{Name: "platform"},
+		Spec: managev1.ClusterAddonSpec{
+			Labels:      map[string]string{"team": "platform", LabelOwner: "someone-else"},
+			Annotations: map[string]string{"contact": "platform@example.com"},
+		},
+	}
+
+	It("stamps objects with kcm and user labels", func() {
+		obj := newObject("v1", "ConfigMap", "ka", "cfg")
+		obj.SetLabels(map[string]string{"app": "ka"})
+		addon := managev1.Addon{Name: "stack", Labels: map[string]string{"team": "ka"}}
+
+		stampObjects([]*unstructured.Unstructured{obj}, instance, addon, "v1.0.0+build.1")
+
+		Expect(obj.GetLabels()).To(Equal(map[string]string{
+			"app":        "ka",
+			"team":       "ka",
+			LabelAddon:   "stack",
+			LabelOwner:   "platform",
+			LabelVersion: "v1.0.0_build.1",
+		}))
+		Expect(obj.GetAnnotations()).To(Equal(map[string]string{
+			"contact":       "platform@example.com",
+			AnnotationOwner: "platform",
+		}))
+	})
+
+	It("keeps the owner labels of long names sharing a prefix apart", func() {
+		prefix := strings.Repeat("platform-", 7)
+		one := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: prefix + "one"}}
+		two := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: prefix + "two"}}
+
+		owner := ownerLabels(one, "stack")[LabelOwner]
+		Expect(validation.IsValidLabelValue(owner)).To(BeEmpty())
+		Expect(owner).To(HavePrefix(prefix[:40]))
+		Expect(owner).NotTo(Equal(ownerLabels(two, "stack")[LabelOwner]))
+		Expect(ownerLabels(one, "stack")[LabelOwner]).To(Equal(owner))
+	})
+
+	It("finds labelled objects missing from the recorded inventory", func() {
+		gv := schema.GroupVersion{Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+
+		labelled := func(name string, owner string) runtime.Object {
+			obj := newObject("v1", "ConfigMap", "ka", name)
+			obj.SetLabels(map[string]string{LabelAddon: "stack", LabelOwner: owner})
+			return obj
+		}
+		r := &ClusterAddonReconciler{
+			RESTMapper: mapper,
+			DynamicClient: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{gv.WithResource("configmaps"): "ConfigMapList"},
+				labelled("cfg", "platform"), labelled("leftover", "platform"), labelled("foreign", "other")),
+		}
+
+		state := &managev1.AddonState{Version: "v0.1.0", Inventory: []managev1.ObjectReference{
+			{APIVersion: "v1", Kind: "ConfigMap", Namespace: "ka", Name: "cfg"},
+		}}
+		objs, err := r.installedObjects(ctx, instance, "stack", AddonManifest{Namespace: ptr.To("ka")}, state)
+		Expect(err).NotTo(HaveOccurred())
+
+		names := []string{}
+		for _, obj := range objs {
+			names = append(names, obj.GetName())
+		}
+		Expect(names).To(Equal([]string{"cfg", "leftover"}))
+	})
+
+	It("retries an uninstall which already removed some objects", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+		defer srv.Close()
+		addonManifests["uninstall"] = AddonManifest{URL: func(string) string { return srv.URL }}
+		defer delete(addonManifests, "uninstall")
+
+		core, apps := schema.GroupVersion{Version: "v1"}, schema.GroupVersion{Group: "apps", Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{core, apps})
+		mapper.Add(core.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+		mapper.Add(core.WithKind("Namespace"), meta.RESTScopeRoot)
+		mapper.Add(apps.WithKind("Deployment"), meta.RESTScopeNamespace)
+
+		dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{
+				core.WithResource("configmaps"):  "ConfigMapList",
+				core.WithResource("namespaces"):  "NamespaceList",
+				apps.WithResource("deployments"): "DeploymentList",
+			},
+			newObject("v1", "Namespace", "", "extra"), newObject("v1", "ConfigMap", "ka", "cfg"))
+		var deleted []string
+		dc.PrependReactor("delete", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			deleted = append(deleted, action.GetResource().Resource)
+			return false, nil, nil
+		})
+
+		store := NewMemoryStateStore()
+		owner := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "uninstall"}}
+		Expect(store.Set(ctx, owner, "uninstall", managev1.AddonState{Version: "v0.1.0", Inventory: []managev1.ObjectReference{
+			{APIVersion: "v1", Kind: "Namespace", Name: "extra"},
+			{APIVersion: "v1", Kind: "ConfigMap", Namespace: "ka", Name: "cfg"},
+			{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "ka", Name: "web"},
+		}})).To(Succeed())
+		disco := &discoveryfake.FakeDiscovery{Fake: &clienttesting.Fake{}}
+		r := &ClusterAddonReconciler{
+			Client:        newFakeClient(),
+			RESTMapper:    mapper,
+			DynamicClient: dc,
+			State:         store,
+			Discovery:     preferredDiscovery{FakeDiscovery: disco},
+		}
+
+		addon := managev1.Addon{Name: "uninstall", Version: ptr.To("v0.1.0")}
+		Expect(r.HandleAddonDelete(ctx, owner, addon)).To(Succeed())
+		Expect(deleted).To(Equal([]string{"deployments", "configmaps", "namespaces"}))
+
+		// The state is only forgotten at the end, a retry finds everything gone
+		Expect(store.Set(ctx, owner, "uninstall", managev1.AddonState{Version: "v0.1.0", Inventory: []managev1.ObjectReference{
+			{APIVersion: "v1", Kind: "ConfigMap", Namespace: "ka", Name: "cfg"},
+		}})).To(Succeed())
+		Expect(r.HandleAddonDelete(ctx, owner, addon)).To(Succeed())
+		state, err := store.Get(ctx, owner, "uninstall")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(BeNil())
+	})
+})
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Verbosity levels used with logr, zap prints V(logLevelDebug) with
+// --zap-log-level=debug and V(logLevelTrace) with --zap-log-level=2.
+const (
+	logLevelDebug = 1
+	logLevelTrace = 2
+)
+
+const redacted = "<redacted>"
+
+// objectLogger returns the logger from ctx annotated with the identity of obj.
+func objectLogger(ctx context.Context, obj *unstructured.Unstructured) logr.Logger {
+	return log.FromContext(ctx).WithValues(
+		"gvk", obj.GroupVersionKind().String(),
+		"namespace", obj.GetNamespace(),
+		"name", obj.GetName(),
+	)
+}
+
+// dumpObject logs the full object at trace level, with the payload of
+// Secrets redacted.
+func dumpObject(l logr.Logger, msg string, obj *unstructured.Unstructured) {
+	if !l.V(logLevelTrace).Enabled() {
+		return
+	}
+	l.V(logLevelTrace).Info(msg, "object", redactObject(obj).Object)
+}
+
+func redactObject(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	if obj.GroupVersionKind().Group != "" || obj.GetKind() != "Secret" {
+		return obj
+	}
+
+	out := obj.DeepCopy()
+	for _, field := range []string{"data", "stringData"} {
+		values, found, err := unstructured.NestedMap(out.Object, field)
+		if err != nil || !found {
+			continue
+		}
+		for k := range values {
+			values[k] = redacted
+		}
+		_ = unstructured.SetNestedMap(out.Object, values, field)
+	}
+
+	// kubectl stashes the whole object, payload included, in this annotation
+	annotations := out.GetAnnotations()
+	if _, ok := annotations["kubectl.kubernetes.io/last-applied-configuration"]; ok {
+		annotations["kubectl.kubernetes.io/last-applied-configuration"] = redacted
+		out.SetAnnotations(annotations)
+	}
+	return out
+}
@@ -0,0 +1,31 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var _ = Describe("Object dumps", func() {
+	It("redacts the payload of Secrets", func() {
+		secret := newObject("v1", "Secret", "ka", "creds")
+		Expect(unstructured.SetNestedStringMap(secret.Object, map[string]string{"password": "aHVudGVyMg=="}, "data")).To(Succeed())
+		Expect(unstructured.SetNestedStringMap(secret.Object, map[string]string{"token": "hunter2"}, "stringData")).To(Succeed())
+		secret.SetAnnotations(map[string]string{"kubectl.kubernetes.io/last-applied-configuration": `{"data":{}}`})
+
+		out := redactObject(secret)
+		Expect(out.Object).To(HaveKeyWithValue("data", map[string]interface{}{"password": redacted}))
+		Expect(out.Object).To(HaveKeyWithValue("stringData", map[string]interface{}{"token": redacted}))
+		Expect(out.GetAnnotations()).To(HaveKeyWithValue("kubectl.kubernetes.io/last-applied-configuration", redacted))
+
+		password, _, _ := unstructured.NestedString(secret.Object, "data", "password")
+		Expect(password).To(Equal("aHVudGVyMg=="), "the original object must be left untouched")
+	})
+
+	It("leaves other kinds as they are", func() {
+		cm := newObject("v1", "ConfigMap", "ka", "cfg")
+		Expect(unstructured.SetNestedStringMap(cm.Object, map[string]string{"key": "value"}, "data")).To(Succeed())
+
+		Expect(redactObject(cm)).To(BeIdenticalTo(cm))
+	})
+})
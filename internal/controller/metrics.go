@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	operationInstall   = "install"
+	operationUpgrade   = "upgrade"
+	operationUninstall = "uninstall"
+	operationRollback  = "rollback"
+
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+var (
+	addonOperationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kcm_addon_operations_total",
+			Help: "Number of addon installs, upgrades and uninstalls by addon and result.",
+		},
+		[]string{"addon", "operation", "result"},
+	)
+
+	manifestDownloadDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kcm_addon_manifest_download_duration_seconds",
+			Help:    "Time taken to download and decode an addon manifest.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"addon"},
+	)
+
+	manifestDownloadBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kcm_addon_manifest_download_bytes",
+			Help:    "Size of the downloaded addon manifests.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+		},
+		[]string{"addon"},
+	)
+
+	objectsAppliedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kcm_addon_objects_applied_total",
+			Help: "Number of objects applied to the cluster by addon.",
+		},
+		[]string{"addon"},
+	)
+
+	versionResolutionFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kcm_addon_version_resolution_failures_total",
+			Help: "Number of times the version of an addon could not be resolved.",
+		},
+		[]string{"addon"},
+	)
+
+	addonInstalledInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kcm_addon_installed_info",
+			Help: "Installed version of each addon, the value is always 1.",
+		},
+		[]string{"addon", "version"},
+	)
+
+	driftCorrectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kcm_addon_drift_corrections_total",
+			Help: "Number of times kcm reverted out of band changes to objects of an addon.",
+		},
+		[]string{"addon"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		addonOperationsTotal,
+		manifestDownloadDuration,
+		manifestDownloadBytes,
+		objectsAppliedTotal,
+		versionResolutionFailuresTotal,
+		addonInstalledInfo,
+		driftCorrectionsTotal,
+	)
+}
+
+func recordOperation(addonName, operation string, err error) {
+	if pending(err) {
+		return // The operation carries on in a later reconcile
+	}
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+	}
+	addonOperationsTotal.WithLabelValues(addonName, operation, result).Inc()
+}
+
+// setInstalledVersion keeps a single kcm_addon_installed_info series per
+// addon, an empty version removes it.
+func setInstalledVersion(addonName, version string) {
+	addonInstalledInfo.DeletePartialMatch(prometheus.Labels{"addon": addonName})
+	if version != "" {
+		addonInstalledInfo.WithLabelValues(addonName, version).Set(1)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// ignoredNamespaceResources are kept up to date by Kubernetes for other
+// objects, they never keep kcm from deleting a namespace.
+var ignoredNamespaceResources = []schema.GroupResource{
+	{Resource: "events"},
+	{Group: "events.k8s.io", Resource: "events"},
+	{Resource: "endpoints"},
+}
+
+// defaultNamespaceObjects are created by Kubernetes in every namespace.
+var defaultNamespaceObjects = map[schema.GroupResource]string{
+	{Resource: "configmaps"}:      "kube-root-ca.crt",
+	{Resource: "serviceaccounts"}: "default",
+}
+
+func namespacePolicy(addon managev1.Addon) managev1.NamespacePolicy {
+	if addon.NamespacePolicy == nil {
+		return managev1.NamespacePolicy{}
+	}
+	return *addon.NamespacePolicy
+}
+
+func namespaceOwned(addon managev1.Addon) bool {
+	owned := namespacePolicy(addon).Owned
+	return owned == nil || *owned
+}
+
+func isNamespace(obj *unstructured.Unstructured) bool {
+	return obj.GroupVersionKind().GroupKind() == schema.GroupKind{Kind: "Namespace"}
+}
+
+// setNamespacePolicy sets the labels and annotations of the namespace policy on
+// the namespaces shipped in the manifest of the addon.
+func setNamespacePolicy(objs []*unstructured.Unstructured, addon managev1.Addon) {
+	policy := namespacePolicy(addon)
+	for _, obj := range objs {
+		if !isNamespace(obj) {
+			continue
+		}
+		labels, annotations := obj.GetLabels(), obj.GetAnnotations()
+		if mergeStringMap(&labels, policy.Labels) {
+			obj.SetLabels(labels)
+		}
+		if mergeStringMap(&annotations, policy.Annotations) {
+			obj.SetAnnotations(annotations)
+		}
+	}
+}
+
+// CreateNamespaceIfNotExists creates the namespace of the addon and keeps the
+// labels and annotations of its namespace policy set on it.
+func (r *ClusterAddonReconciler) CreateNamespaceIfNotExists(ctx context.Context, instance *managev1.ClusterAddon, addon managev1.Addon, namespace string) error {
+	policy := namespacePolicy(addon)
+
+	ns := &corev1.Namespace{}
+	if err := r.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+
+		ns = &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        namespace,
+				Labels:      maps.Clone(policy.Labels),
+				Annotations: maps.Clone(policy.Annotations),
+			},
+		}
+		if namespaceOwned(addon) {
+			if ns.Labels == nil {
+				ns.Labels = map[string]string{}
+			}
+			maps.Copy(ns.Labels, ownerLabels(instance, addon.Name))
+		}
+		return r.Create(ctx, ns)
+	}
+
+	labelsChanged := mergeStringMap(&ns.Labels, policy.Labels)
+	annotationsChanged := mergeStringMap(&ns.Annotations, policy.Annotations)
+	if !labelsChanged && !annotationsChanged {
+		return nil
+	}
+	return r.Update(ctx, ns)
+}
+
+// DeleteNamespaceIfExists deletes the namespace of the addon, unless the addon
+// does not own it or it holds resources which are not part of the addon. Like
+// the other objects of the addon, it is deleted with the addon's identity.
+func (r *ClusterAddonReconciler) DeleteNamespaceIfExists(ctx context.Context, instance *managev1.ClusterAddon, addon managev1.Addon, namespace string) error {
+	obj := namespaceObject(namespace, addon)
+	dr, err := r.resourceInterface(ctx, obj)
+	if err != nil {
+		return err
+	}
+	if _, err := dr.Get(ctx, namespace, metav1.GetOptions{}); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	retain, err := r.retainNamespace(ctx, instance, addon, namespace)
+	if err != nil {
+		return err
+	}
+	if retain != "" {
+		log.FromContext(ctx).Info("Keeping addon namespace", "namespace", namespace, "reason", retain)
+		r.event(instance, EventReasonNamespaceRetained, "Kept namespace %s of addon %s: %s", namespace, addon.Name, retain)
+		return nil
+	}
+
+	return r.pruneResource(ctx, obj)
+}
+
+// retainNamespace returns why the namespace of the addon must be kept on
+// uninstall, or an empty string if it can be deleted.
+func (r *ClusterAddonReconciler) retainNamespace(ctx context.Context, instance *managev1.ClusterAddon, addon managev1.Addon, namespace string) (string, error) {
+	if !namespaceOwned(addon) {
+		return "not owned by the addon", nil
+	}
+
+	foreign, err := r.foreignNamespaceObjects(ctx, instance, addon.Name, namespace)
+	if err != nil {
+		return "", fmt.Errorf("failed to check namespace %s for foreign resources: %w", namespace, err)
+	}
+	if len(foreign) == 0 {
+		return "", nil
+	}
+
+	const shown = 5
+	names := make([]string, 0, shown)
+	for i, ref := range foreign {
+		if i == shown {
+			names = append(names, fmt.Sprintf("and %d more", len(foreign)-shown))
+			break
+		}
+		names = append(names, ref.Kind+"/"+ref.Name)
+	}
+	return "it holds resources which are not part of the addon: " + strings.Join(names, ", "), nil
+}
+
+// foreignNamespaceObjects returns the objects in the namespace which neither
+// belong to the addon nor are owned by another object.
+func (r *ClusterAddonReconciler) foreignNamespaceObjects(ctx context.Context, instance *managev1.ClusterAddon, addonName, namespace string) ([]managev1.ObjectReference, error) {
+	if r.Discovery == nil {
+		return nil, fmt.Errorf("no discovery client configured")
+	}
+
+	// An unavailable aggregated API, such as a metrics server which is down,
+	// fails only its own group
+	lists, err := r.Discovery.ServerPreferredNamespacedResources()
+	if discovery.IsGroupDiscoveryFailedError(err) {
+		failed := err.(*discovery.ErrGroupDiscoveryFailed).Groups
+		log.FromContext(ctx).Info("Skipping API groups which failed discovery", "groups", slices.Collect(maps.Keys(failed)))
+	} else if err != nil {
+		return nil, err
+	}
+
+	owner := ownerLabels(instance, addonName)
+
+	var foreign []managev1.ObjectReference
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, res := range list.APIResources {
+			gr := gv.WithResource(res.Name).GroupResource()
+			if strings.Contains(res.Name, "/") || !slices.Contains(res.Verbs, "list") || slices.Contains(ignoredNamespaceResources, gr) {
+				continue
+			}
+
+			objs, err := r.dynamicClient(ctx).Resource(gv.WithResource(res.Name)).Namespace(namespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to list %s: %w", gr, err)
+			}
+
+			for i := range objs.Items {
+				obj := &objs.Items[i]
+				if isAddonObject(obj, owner) || len(obj.GetOwnerReferences()) > 0 || defaultNamespaceObjects[gr] == obj.GetName() {
+					continue
+				}
+				foreign = append(foreign, objectReference(obj))
+			}
+		}
+	}
+	return foreign, nil
+}
+
+func isAddonObject(obj *unstructured.Unstructured, owner map[string]string) bool {
+	l := obj.GetLabels()
+	for k, v := range owner {
+		if l[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeStringMap sets the entries of src in dst, it reports whether dst changed.
+func mergeStringMap(dst *map[string]string, src map[string]string) bool {
+	changed := false
+	for k, v := range src {
+		if cur, ok := (*dst)[k]; ok && cur == v {
+			continue
+		}
+		if *dst == nil {
+			*dst = map[string]string{}
+		}
+		(*dst)[k] = v
+		changed = true
+	}
+	return changed
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// preferredDiscovery serves the fake resources as the preferred ones, which
+// the fake discovery client leaves empty.
+type preferredDiscovery struct {
+	*discoveryfake.FakeDiscovery
+	err error
+}
+
+func (d preferredDiscovery) ServerPreferredNamespacedResources() ([]*metav1.APIResourceList, error) {
+	return d.Resources, d.err
+}
+
+var _ = Describe("Addon namespace", func() {
+	ctx := context.Background()
+	instance := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "platform"}}
+	addon := managev1.Addon{Name: "stack", NamespacePolicy: &managev1.NamespacePolicy{
+		Labels: map[string]string{"pod-security.kubernetes.io/enforce": "restricted"},
+	}}
+
+	newReconciler := func(objs ...runtime.Object) *ClusterAddonReconciler {
+		disco := &discoveryfake.FakeDiscovery{Fake: &clienttesting.Fake{}}
+		disco.Resources = []*metav1.APIResourceList{{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "configmaps", Kind: "ConfigMap", Namespaced: true, Verbs: metav1.Verbs{"list", "delete"}},
+				{Name: "events", Kind: "Event", Namespaced: true, Verbs: metav1.Verbs{"list"}},
+			},
+		}}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{{Version: "v1"}})
+		mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+		objs = append(objs, newObject("v1", "Namespace", "", "ka"))
+		return &ClusterAddonReconciler{
+			Client:     newFakeClient(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ka"}}),
+			Discovery:  preferredDiscovery{FakeDiscovery: disco},
+			RESTMapper: mapper,
+			DynamicClient: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{
+					{Version: "v1", Resource: "configmaps"}: "ConfigMapList",
+					{Version: "v1", Resource: "events"}:     "EventList",
+					{Version: "v1", Resource: "namespaces"}: "NamespaceList",
+				}, objs...),
+		}
+	}
+
+	namespaceExists := func(r *ClusterAddonReconciler) bool {
+		_, err := r.DynamicClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}).
+			Get(ctx, "ka", metav1.GetOptions{})
+		Expect(err == nil || apierrors.IsNotFound(err)).To(BeTrue())
+		return err == nil
+	}
+
+	It("keeps the labels of the namespace policy set", func() {
+		r := newReconciler()
+		Expect(r.CreateNamespaceIfNotExists(ctx, instance, addon, "ka")).To(Succeed())
+		Expect(r.CreateNamespaceIfNotExists(ctx, instance, addon, "ka-extra")).To(Succeed())
+
+		ns := &corev1.Namespace{}
+		Expect(r.Get(ctx, client.ObjectKey{Name: "ka"}, ns)).To(Succeed())
+		Expect(ns.Labels).To(Equal(addon.NamespacePolicy.Labels))
+
+		Expect(r.Get(ctx, client.ObjectKey{Name: "ka-extra"}, ns)).To(Succeed())
+		Expect(ns.Labels).To(HaveKeyWithValue(LabelOwner, "platform"))
+		Expect(ns.Labels).To(HaveKeyWithValue("pod-security.kubernetes.io/enforce", "restricted"))
+
+		// Also on the namespaces the manifest ships
+		shipped := newObject("v1", "Namespace", "", "ka-shipped")
+		shipped.SetLabels(map[string]string{"app": "ka"})
+		setNamespacePolicy([]*unstructured.Unstructured{shipped, newObject("v1", "ConfigMap", "ka", "cfg")}, addon)
+		Expect(shipped.GetLabels()).To(Equal(map[string]string{"app": "ka", "pod-security.kubernetes.io/enforce": "restricted"}))
+	})
+
+	It("deletes the namespace when it only holds addon resources", func() {
+		cfg := newObject("v1", "ConfigMap", "ka", "cfg")
+		cfg.SetLabels(ownerLabels(instance, "stack"))
+		r := newReconciler(cfg, newObject("v1", "ConfigMap", "ka", "kube-root-ca.crt"), newObject("v1", "Event", "ka", "ev"))
+
+		Expect(r.DeleteNamespaceIfExists(ctx, instance, addon, "ka")).To(Succeed())
+		Expect(namespaceExists(r)).To(BeFalse())
+	})
+
+	It("keeps namespaces holding foreign resources or not owned by the addon", func() {
+		r := newReconciler(newObject("v1", "ConfigMap", "ka", "users-config"))
+		Expect(r.DeleteNamespaceIfExists(ctx, instance, addon, "ka")).To(Succeed())
+		Expect(namespaceExists(r)).To(BeTrue())
+
+		retain, err := r.retainNamespace(ctx, instance, addon, "ka")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(retain).To(ContainSubstring("ConfigMap/users-config"))
+
+		notOwned := managev1.Addon{Name: "stack", NamespacePolicy: &managev1.NamespacePolicy{Owned: ptr.To(false)}}
+		r = newReconciler()
+		Expect(r.DeleteNamespaceIfExists(ctx, instance, notOwned, "ka")).To(Succeed())
+		Expect(namespaceExists(r)).To(BeTrue())
+	})
+
+	It("only deletes a namespace shipped in the manifest when it holds nothing else", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+		defer srv.Close()
+		addonManifests["shipped"] = AddonManifest{URL: func(string) string { return srv.URL }}
+		defer delete(addonManifests, "shipped")
+		shipped := managev1.Addon{Name: "shipped", Version: ptr.To("v0.1.0")}
+
+		uninstall := func(r *ClusterAddonReconciler) {
+			cfg := newObject("v1", "ConfigMap", "ka", "cfg")
+			cfg.SetLabels(ownerLabels(instance, "shipped"))
+			_, err := r.DynamicClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}).
+				Namespace("ka").Create(ctx, cfg, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			r.RESTMapper.(*meta.DefaultRESTMapper).Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+			r.State = NewMemoryStateStore()
+			Expect(r.State.Set(ctx, instance, "shipped", managev1.AddonState{Version: "v0.1.0", Inventory: []managev1.ObjectReference{
+				{APIVersion: "v1", Kind: "Namespace", Name: "ka"},
+				{APIVersion: "v1", Kind: "ConfigMap", Namespace: "ka", Name: "cfg"},
+			}})).To(Succeed())
+			Expect(r.HandleAddonDelete(ctx, instance, shipped)).To(Succeed())
+		}
+
+		r := newReconciler(newObject("v1", "ConfigMap", "ka", "users-config"))
+		uninstall(r)
+		Expect(namespaceExists(r)).To(BeTrue())
+
+		r = newReconciler()
+		uninstall(r)
+		Expect(namespaceExists(r)).To(BeFalse())
+	})
+
+	It("checks the groups which were discovered when others failed", func() {
+		r := newReconciler(newObject("v1", "ConfigMap", "ka", "users-config"))
+		r.Discovery = preferredDiscovery{
+			FakeDiscovery: r.Discovery.(preferredDiscovery).FakeDiscovery,
+			err: &discovery.ErrGroupDiscoveryFailed{Groups: map[schema.GroupVersion]error{
+				{Group: "metrics.k8s.io", Version: "v1beta1"}: fmt.Errorf("service unavailable"),
+			}},
+		}
+
+		retain, err := r.retainNamespace(ctx, instance, addon, "ka")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(retain).To(ContainSubstring("ConfigMap/users-config"))
+	})
+})
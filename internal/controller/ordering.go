@@ -0,0 +1,242 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// kindOrder is the order objects of well-known kinds are applied in, so
+// whatever an object refers to exists before it. Kinds not listed, custom
+// resources mostly, go last.
+var kindOrder = []string{
+	"Namespace",
+	"CustomResourceDefinition",
+	"NetworkPolicy",
+	"ResourceQuota",
+	"LimitRange",
+	"PriorityClass",
+	"PodDisruptionBudget",
+	"ServiceAccount",
+	"Secret",
+	"ConfigMap",
+	"StorageClass",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"ReplicaSet",
+	"Deployment",
+	"HorizontalPodAutoscaler",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"IngressClass",
+	"Ingress",
+	"APIService",
+	"MutatingWebhookConfiguration",
+	"ValidatingWebhookConfiguration",
+}
+
+var (
+	crdEstablishTimeout      = time.Minute
+	crdEstablishPollInterval = time.Second
+
+	// noMatchBackoff paces the rediscovery of kinds the RESTMapper does not
+	// know, their CRD may have been created moments ago.
+	noMatchBackoff = wait.Backoff{Steps: 3, Duration: time.Second, Factor: 2}
+)
+
+func kindPriority(obj *unstructured.Unstructured) int {
+	if i := slices.Index(kindOrder, obj.GetKind()); i >= 0 {
+		return i
+	}
+	return len(kindOrder)
+}
+
+// sortByKind returns objs ordered by kindOrder, keeping the manifest order
+// of objects of the same priority.
+func sortByKind(objs []*unstructured.Unstructured) []*unstructured.Unstructured {
+	sorted := slices.Clone(objs)
+	slices.SortStableFunc(sorted, func(a, b *unstructured.Unstructured) int {
+		return kindPriority(a) - kindPriority(b)
+	})
+	return sorted
+}
+
+// deletionOrder returns objs in the reverse of the order they are applied
+// in, so objects go before their namespace and custom resources before
+// their CRD.
+func deletionOrder(objs []*unstructured.Unstructured) []*unstructured.Unstructured {
+	sorted := sortByKind(objs)
+	slices.Reverse(sorted)
+	return sorted
+}
+
+// isFoundational reports whether other objects of a manifest may depend on
+// obj existing before they can be applied.
+func isFoundational(obj *unstructured.Unstructured) bool {
+	return isCRD(obj) || obj.GroupVersionKind().GroupKind() == schema.GroupKind{Kind: "Namespace"}
+}
+
+// applyStaged applies the CustomResourceDefinitions and Namespaces of objs
+// first and then the rest ordered by kind. When live is set, i.e. apply
+// changes the cluster rather than planning, it waits for the CRDs to be
+// established in between and applies objects of the same kind priority
+// with up to ApplyConcurrency workers.
+func (r *ClusterAddonReconciler) applyStaged(
+	ctx context.Context,
+	objs []*unstructured.Unstructured,
+	apply func(ctx context.Context, obj *unstructured.Unstructured) error,
+	live bool,
+) error {
+	workers := 1
+	if live {
+		workers = r.ApplyConcurrency
+	}
+
+	var foundational, rest []*unstructured.Unstructured
+	for _, obj := range sortByKind(objs) {
+		if isFoundational(obj) {
+			foundational = append(foundational, obj)
+		} else {
+			rest = append(rest, obj)
+		}
+	}
+
+	if err := operateTiers(ctx, foundational, apply, workers); err != nil {
+		return err
+	}
+
+	crds := slices.DeleteFunc(slices.Clone(foundational), func(obj *unstructured.Unstructured) bool { return !isCRD(obj) })
+	if live && len(crds) > 0 {
+		if err := r.waitEstablished(ctx, crds); err != nil {
+			return err
+		}
+		r.resetRESTMapper(ctx)
+	}
+
+	return operateTiers(ctx, rest, apply, workers)
+}
+
+// operateTiers runs operator on objs, sorted by kind, one kind priority
+// after the other. The objects of a tier do not depend on each other and
+// are handled by up to workers goroutines, all of their errors are returned.
+func operateTiers(
+	ctx context.Context,
+	objs []*unstructured.Unstructured,
+	operator func(ctx context.Context, obj *unstructured.Unstructured) error,
+	workers int,
+) error {
+	for len(objs) > 0 {
+		n := 1
+		for n < len(objs) && kindPriority(objs[n]) == kindPriority(objs[0]) {
+			n++
+		}
+		tier := objs[:n]
+		objs = objs[n:]
+
+		if workers <= 1 || len(tier) == 1 {
+			if err := operateResources(ctx, tier, operator); err != nil {
+				return err
+			}
+			continue
+		}
+
+		errs := make([]error, len(tier))
+		sem := make(chan struct{}, workers)
+		var wg sync.WaitGroup
+		for i, obj := range tier {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				errs[i] = operateResources(ctx, []*unstructured.Unstructured{obj}, operator)
+			}()
+		}
+		wg.Wait()
+
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitEstablished waits for the api server to serve the given CRDs.
+func (r *ClusterAddonReconciler) waitEstablished(ctx context.Context, crds []*unstructured.Unstructured) error {
+	for _, crd := range crds {
+		dr, err := r.resourceInterface(ctx, crd)
+		if err != nil {
+			return err
+		}
+
+		err = wait.PollUntilContextTimeout(ctx, crdEstablishPollInterval, crdEstablishTimeout, true, func(ctx context.Context) (bool, error) {
+			live, err := dr.Get(ctx, crd.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return crdEstablished(live), nil
+		})
+		if err != nil {
+			return fmt.Errorf("CustomResourceDefinition %s is not established: %w", crd.GetName(), err)
+		}
+	}
+	return nil
+}
+
+func crdEstablished(crd *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if ok && cond["type"] == "Established" && cond["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// resetRESTMapper makes the RESTMapper rediscover the api server, so kinds of
+// freshly installed CRDs can be mapped.
+func (r *ClusterAddonReconciler) resetRESTMapper(ctx context.Context) {
+	if rm, ok := r.RESTMapper.(meta.ResettableRESTMapper); ok {
+		log.FromContext(ctx).V(logLevelDebug).Info("Resetting REST mapper")
+		rm.Reset()
+	}
+}
+
+// restMapping maps gvk, rediscovering the api server while the RESTMapper
+// does not know the kind.
+func (r *ClusterAddonReconciler) restMapping(ctx context.Context, gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapping, err := r.RESTMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if !meta.IsNoMatchError(err) {
+		return mapping, err
+	}
+
+	err = retry.OnError(noMatchBackoff, meta.IsNoMatchError, func() error {
+		log.FromContext(ctx).V(logLevelDebug).Info("Kind unknown to the REST mapper, rediscovering", "kind", gvk.String())
+		r.resetRESTMapper(ctx)
+		mapping, err = r.RESTMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		return err
+	})
+	return mapping, err
+}
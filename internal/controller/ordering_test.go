@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// resettableMapper counts how often the reconciler resets it, kinds added to
+// discovered only become known once it was reset.
+type resettableMapper struct {
+	*meta.DefaultRESTMapper
+	resets     int
+	discovered []schema.GroupVersionKind
+}
+
+func (m *resettableMapper) Reset() {
+	m.resets++
+	for _, gvk := range m.discovered {
+		m.Add(gvk, meta.RESTScopeNamespace)
+	}
+}
+
+var _ = Describe("Staged apply", func() {
+	ctx := context.Background()
+
+	crd := func(name string, established bool) *unstructured.Unstructured {
+		obj := newObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", name)
+		if established {
+			Expect(unstructured.SetNestedSlice(obj.Object, []interface{}{
+				map[string]interface{}{"type": "Established", "status": "True"},
+			}, "status", "conditions")).To(Succeed())
+		}
+		return obj
+	}
+
+	newReconciler := func(objs ...runtime.Object) (*ClusterAddonReconciler, *resettableMapper) {
+		gv := schema.GroupVersion{Group: "apiextensions.k8s.io", Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("CustomResourceDefinition"), meta.RESTScopeRoot)
+		rm := &resettableMapper{DefaultRESTMapper: mapper}
+		return &ClusterAddonReconciler{
+			RESTMapper:    rm,
+			DynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objs...),
+		}, rm
+	}
+
+	It("orders objects by kind keeping the manifest order otherwise", func() {
+		objs := []*unstructured.Unstructured{
+			newObject("example.com/v1", "Widget", "ka", "w"),
+			newObject("apps/v1", "Deployment", "ka", "web"),
+			newObject("v1", "ConfigMap", "ka", "b"),
+			newObject("v1", "ServiceAccount", "ka", "sa"),
+			newObject("v1", "ConfigMap", "ka", "a"),
+		}
+
+		var names []string
+		for _, obj := range sortByKind(objs) {
+			names = append(names, obj.GetName())
+		}
+		Expect(names).To(Equal([]string{"sa", "b", "a", "web", "w"}))
+	})
+
+	It("applies CRDs and namespaces first and waits for the CRDs", func() {
+		r, rm := newReconciler(crd("widgets.example.com", true))
+
+		var applied []string
+		apply := func(_ context.Context, obj *unstructured.Unstructured) error {
+			applied = append(applied, obj.GetKind())
+			return nil
+		}
+
+		objs := []*unstructured.Unstructured{
+			newObject("example.com/v1", "Widget", "ka", "w"),
+			newObject("v1", "ConfigMap", "ka", "cfg"),
+			crd("widgets.example.com", false),
+			newObject("v1", "Namespace", "", "ka"),
+		}
+		Expect(r.applyStaged(ctx, objs, apply, true)).To(Succeed())
+		Expect(applied).To(Equal([]string{"Namespace", "CustomResourceDefinition", "ConfigMap", "Widget"}))
+		Expect(rm.resets).To(Equal(1))
+	})
+
+	It("fails when a CRD is not established in time", func() {
+		defer func(timeout, interval time.Duration) {
+			crdEstablishTimeout, crdEstablishPollInterval = timeout, interval
+		}(crdEstablishTimeout, crdEstablishPollInterval)
+		crdEstablishTimeout, crdEstablishPollInterval = 50*time.Millisecond, 10*time.Millisecond
+
+		r, rm := newReconciler(crd("widgets.example.com", false))
+		noop := func(context.Context, *unstructured.Unstructured) error { return nil }
+
+		err := r.applyStaged(ctx, []*unstructured.Unstructured{crd("widgets.example.com", false)}, noop, true)
+		Expect(err).To(MatchError(ContainSubstring("widgets.example.com is not established")))
+		Expect(rm.resets).To(BeZero())
+	})
+
+	It("rediscovers kinds the REST mapper does not know yet", func() {
+		defer func(b wait.Backoff) { noMatchBackoff = b }(noMatchBackoff)
+		noMatchBackoff = wait.Backoff{Steps: 2, Duration: time.Millisecond}
+
+		r, rm := newReconciler()
+		widget := newObject("example.com/v1", "Widget", "ka", "w")
+
+		_, err := r.resourceInterface(ctx, widget)
+		Expect(meta.IsNoMatchError(err)).To(BeTrue())
+		Expect(rm.resets).To(Equal(2))
+
+		rm.discovered = append(rm.discovered, widget.GroupVersionKind())
+		_, err = r.resourceInterface(ctx, widget)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rm.resets).To(Equal(3))
+	})
+
+	It("applies a tier in parallel and reports every failure", func() {
+		var mu sync.Mutex
+		running, peak := 0, 0
+		apply := func(_ context.Context, obj *unstructured.Unstructured) error {
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if obj.GetName() == "bad-1" || obj.GetName() == "bad-2" {
+				return errors.New("denied")
+			}
+			return nil
+		}
+
+		var objs []*unstructured.Unstructured
+		for _, name := range []string{"a", "b", "bad-1", "c", "bad-2", "d"} {
+			objs = append(objs, newObject("v1", "ConfigMap", "ka", name))
+		}
+		objs = append(objs, newObject("apps/v1", "Deployment", "ka", "web"))
+
+		err := operateTiers(ctx, objs, apply, 3)
+		Expect(err).To(MatchError(ContainSubstring("ka/bad-1")))
+		Expect(err).To(MatchError(ContainSubstring("ka/bad-2")))
+		Expect(peak).To(Equal(3))
+
+		r, _ := newReconciler()
+		r.ApplyConcurrency = 3
+		peak = 0
+		Expect(r.applyStaged(ctx, objs[:2], apply, false)).To(Succeed())
+		Expect(peak).To(Equal(1))
+	})
+})
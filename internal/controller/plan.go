@@ -0,0 +1,233 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// fields the api server owns, they would show up in every diff
+var ignoredDiffFields = [][]string{
+	{"metadata", "managedFields"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "generation"},
+	{"metadata", "uid"},
+	{"metadata", "creationTimestamp"},
+	{"status"},
+}
+
+// resetPlan clears the plan of the previous reconcile, leaving an empty one
+// behind only when the ClusterAddon is in dry-run mode.
+func resetPlan(instance *managev1.ClusterAddon) {
+	if !instance.Spec.DryRun {
+		instance.Status.Plan = nil
+		return
+	}
+	instance.Status.Plan = &managev1.ClusterAddonPlan{GeneratedAt: metav1.Now()}
+}
+
+// startPlan adds the plan entry of the addon, it returns nil when the
+// ClusterAddon is not in dry-run mode.
+func startPlan(instance *managev1.ClusterAddon, addonName, version string) *managev1.AddonPlan {
+	if instance.Status.Plan == nil {
+		return nil
+	}
+
+	plans := &instance.Status.Plan.Addons
+	*plans = append(*plans, managev1.AddonPlan{
+		Name:    addonName,
+		Version: version,
+		Action:  managev1.AddonPlanActionNone,
+	})
+	return &(*plans)[len(*plans)-1]
+}
+
+// planApply returns an operator which server-side dry-run applies each object
+// and records whether it would be created or which of its fields would change.
+// Objects of the kinds in bundled, defined by CRDs of the same manifest, are
+// recorded as created while the cluster does not know their kind yet: their
+// CRDs are not created by a dry-run. Conflicts with other field managers are
+// resolved as the apply would, the plan fails where the apply would.
+func (r *ClusterAddonReconciler) planApply(
+	plan *managev1.AddonPlan,
+	bundled map[schema.GroupKind]struct{},
+	resolver *conflictResolver,
+) func(ctx context.Context, obj *unstructured.Unstructured) error {
+	return func(ctx context.Context, obj *unstructured.Unstructured) error {
+		gvk := obj.GroupVersionKind()
+		if _, ok := bundled[gvk.GroupKind()]; ok {
+			if _, err := r.RESTMapper.RESTMapping(gvk.GroupKind(), gvk.Version); meta.IsNoMatchError(err) {
+				plan.Create = append(plan.Create, objectReference(obj))
+				return nil
+			}
+		}
+
+		dr, err := r.resourceInterface(ctx, obj)
+		if err != nil {
+			return err
+		}
+
+		live, err := dr.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to get live resource: %w", err)
+		}
+		exists := err == nil
+
+		dryRun := []string{metav1.DryRunAll}
+		desired, err := dr.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{FieldManager: fieldManager, DryRun: dryRun})
+		if conflicts := fieldConflicts(obj, err); len(conflicts) > 0 {
+			var forced *unstructured.Unstructured
+			if forced, err = r.applyConflicting(ctx, obj, resolver, conflicts, err); err == nil {
+				desired, err = dr.Apply(ctx, obj.GetName(), forced, metav1.ApplyOptions{
+					FieldManager: fieldManager,
+					Force:        true,
+					DryRun:       dryRun,
+				})
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to dry-run apply resource: %w", err)
+		}
+
+		if !exists {
+			plan.Create = append(plan.Create, objectReference(obj))
+			return nil
+		}
+
+		if fields := diffObjects(live, desired); len(fields) > 0 {
+			plan.Update = append(plan.Update, managev1.ObjectDiff{
+				ObjectReference: objectReference(obj),
+				Fields:          fields,
+			})
+		}
+		return nil
+	}
+}
+
+// crdKinds returns the kinds defined by the CRDs among objs.
+func crdKinds(objs []*unstructured.Unstructured) map[schema.GroupKind]struct{} {
+	kinds := map[schema.GroupKind]struct{}{}
+	for _, obj := range objs {
+		if !isCRD(obj) {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(obj.Object, "spec", "group")
+		kind, _, _ := unstructured.NestedString(obj.Object, "spec", "names", "kind")
+		kinds[schema.GroupKind{Group: group, Kind: kind}] = struct{}{}
+	}
+	return kinds
+}
+
+// planPrune returns an operator recording the objects an upgrade would prune.
+func (r *ClusterAddonReconciler) planPrune(plan *managev1.AddonPlan) func(ctx context.Context, obj *unstructured.Unstructured) error {
+	return r.planRemoval(&plan.Prune)
+}
+
+// planDelete returns an operator recording the objects an uninstall would delete.
+func (r *ClusterAddonReconciler) planDelete(plan *managev1.AddonPlan) func(ctx context.Context, obj *unstructured.Unstructured) error {
+	return r.planRemoval(&plan.Delete)
+}
+
+func (r *ClusterAddonReconciler) planRemoval(refs *[]managev1.ObjectReference) func(ctx context.Context, obj *unstructured.Unstructured) error {
+	return func(ctx context.Context, obj *unstructured.Unstructured) error {
+		dr, err := r.resourceInterface(ctx, obj)
+		if err != nil {
+			return err
+		}
+
+		if _, err := dr.Get(ctx, obj.GetName(), metav1.GetOptions{}); err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to get live resource: %w", err)
+		}
+
+		*refs = append(*refs, objectReference(obj))
+		return nil
+	}
+}
+
+// diffObjects returns the fields which differ between the live object and the
+// desired one, ignoring the fields maintained by the api server.
+func diffObjects(live, desired *unstructured.Unstructured) []managev1.FieldDiff {
+	l, d := live.DeepCopy().Object, desired.DeepCopy().Object
+	for _, f := range ignoredDiffFields {
+		unstructured.RemoveNestedField(l, f...)
+		unstructured.RemoveNestedField(d, f...)
+	}
+
+	var diffs []managev1.FieldDiff
+	diffValues("", l, d, &diffs)
+	return diffs
+}
+
+func diffValues(path string, live, desired interface{}, diffs *[]managev1.FieldDiff) {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		if l, ok := live.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(l)+len(d))
+			for k := range l {
+				keys = append(keys, k)
+			}
+			for k := range d {
+				if _, ok := l[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			slices.Sort(keys)
+
+			for _, k := range keys {
+				diffValues(joinPath(path, k), l[k], d[k], diffs)
+			}
+			return
+		}
+	case []interface{}:
+		if l, ok := live.([]interface{}); ok && len(l) == len(d) {
+			for i := range d {
+				diffValues(fmt.Sprintf("%s[%d]", path, i), l[i], d[i], diffs)
+			}
+			return
+		}
+	}
+
+	if !equality.Semantic.DeepEqual(live, desired) {
+		*diffs = append(*diffs, managev1.FieldDiff{
+			Path:    path,
+			Live:    renderValue(live),
+			Desired: renderValue(desired),
+		})
+	}
+}
+
+func joinPath(path, key string) string {
+	if strings.ContainsAny(key, ".[]") {
+		key = fmt.Sprintf("[%q]", key)
+		return path + key
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func renderValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(raw)
+}
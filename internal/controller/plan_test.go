@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+func newObject(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+var _ = Describe("Dry-run plan", func() {
+	It("reports field level differences ignoring server owned fields", func() {
+		live := newObject("apps/v1", "Deployment", "ka", "web")
+		live.SetResourceVersion("12")
+		live.SetLabels(map[string]string{"app": "web", "tier": "front"})
+		Expect(unstructured.SetNestedField(live.Object, int64(1), "spec", "replicas")).To(Succeed())
+		Expect(unstructured.SetNestedSlice(live.Object, []interface{}{
+			map[string]interface{}{"name": "web", "image": "nginx:1.0"},
+		}, "spec", "template", "spec", "containers")).To(Succeed())
+		Expect(unstructured.SetNestedField(live.Object, int64(1), "status", "readyReplicas")).To(Succeed())
+
+		desired := live.DeepCopy()
+		desired.SetResourceVersion("13")
+		desired.SetLabels(map[string]string{"app": "web"})
+		Expect(unstructured.SetNestedField(desired.Object, int64(3), "spec", "replicas")).To(Succeed())
+		Expect(unstructured.SetNestedSlice(desired.Object, []interface{}{
+			map[string]interface{}{"name": "web", "image": "nginx:2.0"},
+		}, "spec", "template", "spec", "containers")).To(Succeed())
+		Expect(unstructured.SetNestedField(desired.Object, int64(3), "status", "readyReplicas")).To(Succeed())
+
+		Expect(diffObjects(live, desired)).To(Equal([]managev1.FieldDiff{
+			{Path: "metadata.labels.tier", Live: `"front"`},
+			{Path: "spec.replicas", Live: "1", Desired: "3"},
+			{Path: "spec.template.spec.containers[0].image", Live: `"nginx:1.0"`, Desired: `"nginx:2.0"`},
+		}))
+	})
+
+	It("quotes keys which contain path separators", func() {
+		live := newObject("v1", "ConfigMap", "ka", "cfg")
+		desired := live.DeepCopy()
+		Expect(unstructured.SetNestedField(desired.Object, "true", "metadata", "annotations", "example.com/flag")).To(Succeed())
+
+		Expect(diffObjects(live, desired)).To(Equal([]managev1.FieldDiff{
+			{Path: "metadata.annotations", Desired: `{"example.com/flag":"true"}`},
+		}))
+
+		live.SetAnnotations(map[string]string{"example.com/flag": "false"})
+		Expect(diffObjects(live, desired)).To(Equal([]managev1.FieldDiff{
+			{Path: `metadata.annotations["example.com/flag"]`, Live: `"false"`, Desired: `"true"`},
+		}))
+	})
+
+	It("prunes only objects the new version no longer ships", func() {
+		prev := []*unstructured.Unstructured{
+			newObject("apps/v1", "Deployment", "ka", "web"),
+			newObject("v1", "ConfigMap", "ka", "legacy"),
+			newObject("policy/v1beta1", "PodDisruptionBudget", "ka", "web"),
+		}
+		next := []*unstructured.Unstructured{
+			newObject("apps/v1", "Deployment", "ka", "web"),
+			newObject("policy/v1", "PodDisruptionBudget", "ka", "web"),
+		}
+
+		Expect(staleObjects(prev, next)).To(Equal([]*unstructured.Unstructured{prev[1]}))
+	})
+
+	It("plans the custom resources of CRDs shipped in the same manifest as created", func() {
+		crd := newObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", "widgets.example.com")
+		Expect(unstructured.SetNestedField(crd.Object, "example.com", "spec", "group")).To(Succeed())
+		Expect(unstructured.SetNestedField(crd.Object, "Widget", "spec", "names", "kind")).To(Succeed())
+		widget := newObject("example.com/v1", "Widget", "ka", "default")
+
+		bundled := crdKinds([]*unstructured.Unstructured{crd, widget})
+		Expect(bundled).To(Equal(map[schema.GroupKind]struct{}{{Group: "example.com", Kind: "Widget"}: {}}))
+
+		r := &ClusterAddonReconciler{RESTMapper: meta.NewDefaultRESTMapper(nil)}
+		plan := &managev1.AddonPlan{}
+		Expect(r.planApply(plan, bundled, newConflictResolver(managev1.Addon{}))(context.Background(), widget)).To(Succeed())
+		Expect(plan.Create).To(Equal([]managev1.ObjectReference{objectReference(widget)}))
+	})
+
+	It("dry-runs conflicting applies according to the conflict policy", func() {
+		ctx := context.Background()
+		live := newObject("v1", "ConfigMap", "ka", "cfg")
+		Expect(unstructured.SetNestedField(live.Object, "edited", "data", "release")).To(Succeed())
+		dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), live)
+		// The fake drops the apply options, every apply without force conflicts
+		conflicted := false
+		dc.PrependReactor("patch", "configmaps", func(clienttesting.Action) (bool, runtime.Object, error) {
+			if conflicted = !conflicted; conflicted {
+				return true, nil, apierrors.NewApplyConflict([]metav1.StatusCause{
+					{Type: metav1.CauseTypeFieldManagerConflict, Message: `conflict with "kubectl-edit"`, Field: ".data.release"},
+				}, "Apply failed with 1 conflict")
+			}
+			desired := live.DeepCopy()
+			Expect(unstructured.SetNestedField(desired.Object, "one", "data", "release")).To(Succeed())
+			return true, desired, nil
+		})
+
+		gv := schema.GroupVersion{Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+		r := &ClusterAddonReconciler{RESTMapper: mapper, DynamicClient: dc}
+		obj := newObject("v1", "ConfigMap", "ka", "cfg")
+
+		fail := newConflictResolver(managev1.Addon{ConflictPolicy: managev1.ConflictPolicyFail})
+		plan := &managev1.AddonPlan{}
+		Expect(r.planApply(plan, nil, fail)(ctx, obj)).To(MatchError(ContainSubstring("conflicting field managers")))
+		Expect(fail.Conflicts()).To(ConsistOf(HaveField("Resolution", managev1.ConflictPolicyFail)))
+		Expect(plan.Update).To(BeEmpty())
+
+		conflicted = false
+		force := newConflictResolver(managev1.Addon{})
+		Expect(r.planApply(plan, nil, force)(ctx, obj)).To(Succeed())
+		Expect(force.Conflicts()).To(ConsistOf(HaveField("Resolution", managev1.ConflictPolicyForce)))
+		Expect(plan.Update).To(ConsistOf(HaveField("Fields", []managev1.FieldDiff{
+			{Path: "data.release", Live: `"edited"`, Desired: `"one"`},
+		})))
+	})
+})
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// AddonPolicy restricts the objects an addon manifest may contain, it is
+// evaluated against the whole manifest before anything is applied.
+type AddonPolicy struct {
+	// AllowedKinds the manifest may contain, every kind is allowed when empty.
+	AllowedKinds []schema.GroupKind
+	// AllowedNamespaces objects may be placed in besides the namespace of
+	// the addon, every namespace is allowed when empty.
+	AllowedNamespaces []string
+}
+
+// forbiddenClusterRoles may never be bound by an addon, whatever its policy.
+var forbiddenClusterRoles = []string{"cluster-admin"}
+
+// privilegedVerbs let whoever holds them grant themselves more permissions.
+var privilegedVerbs = []string{"escalate", "bind", "impersonate"}
+
+// checkPolicy returns the objects of the manifest which violate the policy
+// of the addon.
+func checkPolicy(manifest AddonManifest, objs []*unstructured.Unstructured) []managev1.PolicyViolation {
+	policy := manifest.Policy
+	var violations []managev1.PolicyViolation
+	violate := func(obj *unstructured.Unstructured, format string, args ...interface{}) {
+		violations = append(violations, managev1.PolicyViolation{
+			ObjectReference: objectReference(obj),
+			Message:         fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, obj := range objs {
+		gk := obj.GroupVersionKind().GroupKind()
+		if len(policy.AllowedKinds) > 0 && !slices.Contains(policy.AllowedKinds, gk) {
+			violate(obj, "kind %s is not allowed", gk)
+		}
+
+		if ns := objectNamespace(obj); ns != "" && !namespaceAllowed(manifest, ns) {
+			violate(obj, "namespace %s is not allowed", ns)
+		}
+
+		if gk.Group == rbacv1.GroupName && (gk.Kind == "ClusterRoleBinding" || gk.Kind == "RoleBinding") {
+			kind, _, _ := unstructured.NestedString(obj.Object, "roleRef", "kind")
+			name, _, _ := unstructured.NestedString(obj.Object, "roleRef", "name")
+			if kind == "ClusterRole" && slices.Contains(forbiddenClusterRoles, name) {
+				violate(obj, "binding the %s ClusterRole is forbidden", name)
+			}
+		}
+
+		if gk.Group == rbacv1.GroupName && (gk.Kind == "ClusterRole" || gk.Kind == "Role") {
+			for _, message := range checkRoleRules(obj) {
+				violate(obj, "%s", message)
+			}
+		}
+	}
+	return violations
+}
+
+// checkRoleRules returns what is wrong with the rules of a Role or
+// ClusterRole: wildcards, which grant kinds added to the cluster later, and
+// privileged verbs.
+func checkRoleRules(obj *unstructured.Unstructured) []string {
+	rules, _, _ := unstructured.NestedSlice(obj.Object, "rules")
+
+	var messages []string
+	for i, rule := range rules {
+		r, _ := rule.(map[string]interface{})
+		for _, field := range []string{"apiGroups", "resources", "verbs"} {
+			values, _, _ := unstructured.NestedStringSlice(r, field)
+			if slices.Contains(values, rbacv1.ResourceAll) {
+				messages = append(messages, fmt.Sprintf("rule %d grants all %s", i, field))
+			}
+		}
+
+		verbs, _, _ := unstructured.NestedStringSlice(r, "verbs")
+		for _, verb := range privilegedVerbs {
+			if slices.Contains(verbs, verb) {
+				messages = append(messages, fmt.Sprintf("rule %d grants the %s verb", i, verb))
+			}
+		}
+	}
+	return messages
+}
+
+// objectNamespace returns the namespace obj lives in, or is, for Namespaces.
+func objectNamespace(obj *unstructured.Unstructured) string {
+	if obj.GroupVersionKind().GroupKind() == (schema.GroupKind{Kind: "Namespace"}) {
+		return obj.GetName()
+	}
+	return obj.GetNamespace()
+}
+
+func namespaceAllowed(manifest AddonManifest, ns string) bool {
+	if len(manifest.Policy.AllowedNamespaces) == 0 {
+		return true
+	}
+	if manifest.Namespace != nil && *manifest.Namespace == ns {
+		return true
+	}
+	return slices.Contains(manifest.Policy.AllowedNamespaces, ns)
+}
+
+// enforcePolicy records the violations of the addon policy and of the
+// validation rules in the addon status, and fails the addon if there are any.
+func (r *ClusterAddonReconciler) enforcePolicy(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addonName string,
+	manifest AddonManifest,
+	version string,
+	objs []*unstructured.Unstructured,
+) error {
+	rules, err := r.validationRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	violations := checkPolicy(manifest, objs)
+	ruleViolations, err := checkValidationRules(rules, objs)
+	if err != nil {
+		return err
+	}
+	violations = append(violations, ruleViolations...)
+
+	addonStatus(instance, addonName).PolicyViolations = violations
+	if len(violations) == 0 {
+		return nil
+	}
+
+	report := make([]string, 0, len(violations))
+	for _, v := range violations {
+		report = append(report, fmt.Sprintf("%s %s/%s: %s", v.Kind, v.Namespace, v.Name, v.Message))
+	}
+	r.warning(instance, EventReasonPolicyViolation, "Addon %s %s violates its policy: %s", addonName, version, strings.Join(report, "; "))
+	return fmt.Errorf("addon %s %s violates its policy: %s", addonName, version, strings.Join(report, "; "))
+}
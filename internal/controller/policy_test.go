@@ -0,0 +1,88 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Addon policy", func() {
+	binding := func(kind, role string) *unstructured.Unstructured {
+		obj := newObject("rbac.authorization.k8s.io/v1", kind, "", "ka")
+		obj.Object["roleRef"] = map[string]interface{}{"kind": "ClusterRole", "name": role}
+		return obj
+	}
+
+	It("allows anything but cluster-admin bindings without restrictions", func() {
+		objs := []*unstructured.Unstructured{
+			newObject("apps/v1", "Deployment", "anywhere", "web"),
+			binding("ClusterRoleBinding", "view"),
+			binding("ClusterRoleBinding", "cluster-admin"),
+		}
+
+		Expect(checkPolicy(AddonManifest{}, objs)).To(Equal([]managev1.PolicyViolation{{
+			ObjectReference: objectReference(objs[2]),
+			Message:         "binding the cluster-admin ClusterRole is forbidden",
+		}}))
+	})
+
+	It("restricts kinds and namespaces", func() {
+		manifest := AddonManifest{
+			Namespace: ptr.To("ka"),
+			Policy: AddonPolicy{
+				AllowedKinds: []schema.GroupKind{
+					{Group: "apps", Kind: "Deployment"},
+					{Kind: "Namespace"},
+				},
+				AllowedNamespaces: []string{"monitoring"},
+			},
+		}
+		objs := []*unstructured.Unstructured{
+			newObject("v1", "Namespace", "", "ka"),
+			newObject("apps/v1", "Deployment", "ka", "web"),
+			newObject("apps/v1", "Deployment", "monitoring", "agent"),
+			newObject("apps/v1", "Deployment", "kube-system", "agent"),
+			newObject("v1", "Secret", "ka", "creds"),
+		}
+
+		violations := checkPolicy(manifest, objs)
+		Expect(violations).To(HaveLen(2))
+		Expect(violations[0].Name).To(Equal("agent"))
+		Expect(violations[0].Message).To(Equal("namespace kube-system is not allowed"))
+		Expect(violations[1].Message).To(Equal("kind Secret is not allowed"))
+	})
+
+	It("rejects roles granting wildcards or privileged verbs", func() {
+		role := func(kind string, rules ...interface{}) *unstructured.Unstructured {
+			obj := newObject("rbac.authorization.k8s.io/v1", kind, "", "ka")
+			obj.Object["rules"] = rules
+			return obj
+		}
+		rule := func(apiGroups, resources, verbs []interface{}) interface{} {
+			return map[string]interface{}{"apiGroups": apiGroups, "resources": resources, "verbs": verbs}
+		}
+		objs := []*unstructured.Unstructured{
+			role("ClusterRole", rule([]interface{}{"apps"}, []interface{}{"deployments"}, []interface{}{"get", "list"})),
+			role("ClusterRole", rule([]interface{}{"*"}, []interface{}{"*"}, []interface{}{"*"})),
+			role("Role", rule([]interface{}{"rbac.authorization.k8s.io"}, []interface{}{"roles"}, []interface{}{"bind", "escalate"})),
+			role("ClusterRole", rule([]interface{}{""}, []interface{}{"serviceaccounts"}, []interface{}{"impersonate"})),
+		}
+
+		messages := []string{}
+		for _, v := range checkPolicy(AddonManifest{}, objs) {
+			messages = append(messages, v.Kind+": "+v.Message)
+		}
+		Expect(messages).To(Equal([]string{
+			"ClusterRole: rule 0 grants all apiGroups",
+			"ClusterRole: rule 0 grants all resources",
+			"ClusterRole: rule 0 grants all verbs",
+			"Role: rule 0 grants the escalate verb",
+			"Role: rule 0 grants the bind verb",
+			"ClusterRole: rule 0 grants the impersonate verb",
+		}))
+	})
+})
@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// RateLimiterOptions configure how fast failed reconciles are retried: per
+// object with an exponential delay from BaseDelay up to MaxDelay, and overall
+// with a token bucket of QPS and Burst. Failing addons do not fail the
+// reconcile, they are requeued with their own backoff.
+type RateLimiterOptions struct {
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	QPS       float64
+	Burst     int
+}
+
+// DefaultRateLimiterOptions match the controller-runtime default.
+var DefaultRateLimiterOptions = RateLimiterOptions{
+	BaseDelay: 5 * time.Millisecond,
+	MaxDelay:  1000 * time.Second,
+	QPS:       10,
+	Burst:     100,
+}
+
+// NewRateLimiter returns the workqueue rate limiter described by opts.
+func NewRateLimiter(opts RateLimiterOptions) workqueue.TypedRateLimiter[reconcile.Request] {
+	return workqueue.NewTypedMaxOfRateLimiter(
+		workqueue.NewTypedItemExponentialFailureRateLimiter[reconcile.Request](opts.BaseDelay, opts.MaxDelay),
+		&workqueue.TypedBucketRateLimiter[reconcile.Request]{Limiter: rate.NewLimiter(rate.Limit(opts.QPS), opts.Burst)},
+	)
+}
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var workloadKinds = []schema.GroupKind{
+	{Group: "apps", Kind: "Deployment"},
+	{Group: "apps", Kind: "StatefulSet"},
+	{Group: "apps", Kind: "DaemonSet"},
+}
+
+// errNotReady is returned while the workloads of an addon roll out, the
+// addon is processed again once they had time to become ready rather than
+// blocking the reconcile.
+var errNotReady = errors.New("waiting for workloads to become ready")
+
+// checkReady checks whether the workloads among objs finished rolling out
+// within the readiness timeout of the addon, counted from the first check of
+// version. It returns errNotReady until they did.
+func (r *ClusterAddonReconciler) checkReady(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addon managev1.Addon,
+	version string,
+	objs []*unstructured.Unstructured,
+) error {
+	status := addonStatus(instance, addon.Name)
+	if status.Readiness == nil || status.Readiness.Version != version {
+		status.Readiness = &managev1.AddonReadiness{
+			Version:  version,
+			Deadline: metav1.NewTime(time.Now().Add(addon.ReadinessTimeout.Duration)),
+		}
+	}
+
+	workload, err := r.pendingWorkload(ctx, objs)
+	if err != nil {
+		status.Readiness = nil
+		return err
+	}
+	if workload == nil {
+		status.Readiness = nil
+		return nil
+	}
+	if time.Now().Before(status.Readiness.Deadline.Time) {
+		return fmt.Errorf("%s %s/%s is not ready: %w", workload.GetKind(), workload.GetNamespace(), workload.GetName(), errNotReady)
+	}
+	status.Readiness = nil
+	return fmt.Errorf("%s %s/%s is not ready within %s", workload.GetKind(), workload.GetNamespace(), workload.GetName(),
+		addon.ReadinessTimeout.Duration)
+}
+
+// pendingWorkload returns the first workload among objs which has not
+// finished rolling out, nil if all of them did.
+func (r *ClusterAddonReconciler) pendingWorkload(ctx context.Context, objs []*unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	for _, obj := range objs {
+		if !slices.Contains(workloadKinds, obj.GroupVersionKind().GroupKind()) {
+			continue
+		}
+
+		dr, err := r.resourceInterface(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		live, err := dr.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return obj, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !workloadReady(live) {
+			return obj, nil
+		}
+	}
+	return nil, nil
+}
+
+// workloadReady reports whether the latest spec of a Deployment, StatefulSet
+// or DaemonSet is rolled out and available.
+func workloadReady(obj *unstructured.Unstructured) bool {
+	observed, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	if observed < obj.GetGeneration() {
+		return false
+	}
+
+	status := func(field string) int64 {
+		v, _, _ := unstructured.NestedInt64(obj.Object, "status", field)
+		return v
+	}
+
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
+	}
+
+	switch obj.GetKind() {
+	case "Deployment":
+		return status("updatedReplicas") >= replicas && status("availableReplicas") >= replicas
+	case "StatefulSet":
+		return status("updatedReplicas") >= replicas && status("readyReplicas") >= replicas
+	case "DaemonSet":
+		desired := status("desiredNumberScheduled")
+		return status("updatedNumberScheduled") >= desired && status("numberAvailable") >= desired
+	}
+	return true
+}
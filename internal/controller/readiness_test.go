@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Addon readiness and rollback", func() {
+	ctx := context.Background()
+
+	deployment := func(name string, generation, observed, updated, available int64) *unstructured.Unstructured {
+		obj := newObject("apps/v1", "Deployment", "ka", name)
+		obj.SetGeneration(generation)
+		obj.Object["spec"] = map[string]interface{}{"replicas": int64(2)}
+		obj.Object["status"] = map[string]interface{}{
+			"observedGeneration": observed,
+			"updatedReplicas":    updated,
+			"availableReplicas":  available,
+		}
+		return obj
+	}
+
+	It("checks that workloads rolled out", func() {
+		Expect(workloadReady(deployment("web", 2, 2, 2, 2))).To(BeTrue())
+		Expect(workloadReady(deployment("web", 2, 1, 2, 2))).To(BeFalse())
+		Expect(workloadReady(deployment("web", 2, 2, 2, 1))).To(BeFalse())
+
+		ds := newObject("apps/v1", "DaemonSet", "ka", "agent")
+		ds.Object["status"] = map[string]interface{}{
+			"desiredNumberScheduled": int64(3),
+			"updatedNumberScheduled": int64(3),
+			"numberAvailable":        int64(2),
+		}
+		Expect(workloadReady(ds)).To(BeFalse())
+		Expect(workloadReady(newObject("v1", "ConfigMap", "ka", "cfg"))).To(BeTrue())
+	})
+
+	It("checks on the workloads until they are ready or run out of time", func() {
+		gv := schema.GroupVersion{Group: "apps", Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("Deployment"), meta.RESTScopeNamespace)
+		r := &ClusterAddonReconciler{
+			RESTMapper: mapper,
+			DynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+				deployment("web", 1, 1, 2, 2), deployment("api", 1, 1, 2, 0)),
+		}
+		instance := &managev1.ClusterAddon{}
+		addon := managev1.Addon{Name: "stack", ReadinessTimeout: &metav1.Duration{Duration: time.Minute}}
+
+		web := newObject("apps/v1", "Deployment", "ka", "web")
+		Expect(r.checkReady(ctx, instance, addon, "v0.1.0", []*unstructured.Unstructured{web})).To(Succeed())
+		Expect(addonStatus(instance, "stack").Readiness).To(BeNil())
+
+		api := newObject("apps/v1", "Deployment", "ka", "api")
+		err := r.checkReady(ctx, instance, addon, "v0.1.0", []*unstructured.Unstructured{web, api})
+		Expect(err).To(MatchError(errNotReady))
+		Expect(err).To(MatchError(ContainSubstring("Deployment ka/api is not ready")))
+		readiness := addonStatus(instance, "stack").Readiness
+		Expect(readiness.Version).To(Equal("v0.1.0"))
+
+		readiness.Deadline = metav1.NewTime(time.Now().Add(-time.Second))
+		err = r.checkReady(ctx, instance, addon, "v0.1.0", []*unstructured.Unstructured{web, api})
+		Expect(err).To(MatchError(ContainSubstring("Deployment ka/api is not ready within 1m0s")))
+		Expect(pending(err)).To(BeFalse())
+		Expect(addonStatus(instance, "stack").Readiness).To(BeNil())
+	})
+
+	It("checks on the workloads in later calls instead of waiting for them", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: ka\n"))
+		}))
+		defer srv.Close()
+		addonManifests["rolling"] = AddonManifest{URL: func(string) string { return srv.URL }}
+		defer delete(addonManifests, "rolling")
+
+		gv := schema.GroupVersion{Group: "apps", Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("Deployment"), meta.RESTScopeNamespace)
+		var applies atomic.Int32
+		dc := applyingDynamicClient(&applies)
+		store := NewMemoryStateStore()
+		r := &ClusterAddonReconciler{Client: newFakeClient(), RESTMapper: mapper, DynamicClient: dc, State: store}
+
+		instance := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "rolling", Generation: 1}}
+		addon := managev1.Addon{Name: "rolling", Version: ptr.To("v0.1.0"), ReadinessTimeout: &metav1.Duration{Duration: time.Hour}}
+		Expect(r.HandleAddon(ctx, instance, addon)).To(MatchError(errNotReady))
+		Expect(r.HandleAddon(ctx, instance, addon)).To(MatchError(errNotReady))
+		Expect(applies.Load()).To(Equal(int32(1)))
+
+		deployments := dc.Resource(gv.WithResource("deployments")).Namespace("ka")
+		Expect(deployments.Update(ctx, deployment("web", 0, 0, 2, 2), metav1.UpdateOptions{})).Error().NotTo(HaveOccurred())
+		Expect(r.HandleAddon(ctx, instance, addon)).To(Succeed())
+		Expect(addonStatus(instance, "rolling").Readiness).To(BeNil())
+		state, err := store.Get(ctx, instance, "rolling")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state.Version).To(Equal("v0.1.0"))
+	})
+
+	It("rolls back unless disabled", func() {
+		Expect(autoRollback(managev1.Addon{})).To(BeTrue())
+		Expect(autoRollback(managev1.Addon{AutoRollback: ptr.To(false)})).To(BeFalse())
+	})
+
+	It("records the failed version when the rollback fails", func() {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+
+		manifest := AddonManifest{URL: func(version string) string { return srv.URL + "/" + version + "/install.yaml" }}
+		instance := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "rollback"}}
+		recorder := record.NewFakeRecorder(10)
+		r := &ClusterAddonReconciler{Client: newFakeClient(), Recorder: recorder}
+
+		cause := errors.New("deployment not ready")
+		err := r.rollback(ctx, instance, managev1.Addon{Name: "stack"}, manifest,
+			&managev1.AddonState{Version: "v0.1.0"}, "v0.2.0", nil, cause)
+		Expect(err).To(MatchError(ContainSubstring("status: 404")))
+
+		Expect(addonStatus(instance, "stack").FailedVersion).To(Equal("v0.2.0"))
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning " + EventReasonRollbackStarted)))
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning " + EventReasonDownloadFailed)))
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning " + EventReasonRollbackFailed)))
+	})
+})
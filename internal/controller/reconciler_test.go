@@ -0,0 +1,347 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("ClusterAddon Controller without a cluster", func() {
+	ctx := context.Background()
+
+	It("marks unsupported addons as failed", func() {
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{Name: "unsupported", Finalizers: []string{managerFinalizer}},
+			Spec: managev1.ClusterAddonSpec{
+				Addons: []managev1.Addon{{Name: "does-not-exist"}},
+			},
+		}
+		c := newFakeClient(instance)
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), State: NewMemoryStateStore()}
+
+		res, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.RequeueAfter).To(BeNumerically(">=", defaultBackoffInitial))
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(instance), instance)).To(Succeed())
+		Expect(instance.Status.StatusCode).To(Equal(managev1.CAddonStatusFailure))
+		retry := addonStatus(instance, "does-not-exist").Retry
+		Expect(retry).NotTo(BeNil())
+		Expect(retry.Attempts).To(Equal(int32(1)))
+		Expect(retry.NextRetryTime).NotTo(BeNil())
+		Expect(retry.LastError).To(ContainSubstring("unsupported addon"))
+
+		// Reconciles triggered before the retry is due leave the addon alone
+		res, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.RequeueAfter).To(And(BeNumerically(">", 0), BeNumerically("<=", 2*defaultBackoffInitial)))
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(instance), instance)).To(Succeed())
+		Expect(addonStatus(instance, "does-not-exist").Retry.Attempts).To(Equal(int32(1)))
+	})
+
+	It("releases the finalizer when nothing was installed", func() {
+		now := metav1.Now()
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "deleting",
+				Finalizers:        []string{managerFinalizer},
+				DeletionTimestamp: &now,
+			},
+			Spec: managev1.ClusterAddonSpec{
+				Addons: []managev1.Addon{{Name: "stack"}},
+			},
+			Status: managev1.ClusterAddonStatus{StatusCode: managev1.CAddonStatusSuccess},
+		}
+		c := newFakeClient(instance)
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), State: NewMemoryStateStore()}
+
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = c.Get(ctx, client.ObjectKeyFromObject(instance), &managev1.ClusterAddon{})
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("releases the finalizer of a ClusterAddon in dry-run mode", func() {
+		now := metav1.Now()
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "dry-run-deleting",
+				Finalizers:        []string{managerFinalizer},
+				DeletionTimestamp: &now,
+			},
+			Spec: managev1.ClusterAddonSpec{
+				Addons: []managev1.Addon{{Name: "stack"}},
+				DryRun: true,
+			},
+			Status: managev1.ClusterAddonStatus{StatusCode: managev1.CAddonStatusSuccess},
+		}
+		c := newFakeClient(instance)
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), State: NewMemoryStateStore()}
+
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = c.Get(ctx, client.ObjectKeyFromObject(instance), &managev1.ClusterAddon{})
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("leaves suspended addons alone while reporting status", func() {
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{Name: "suspended", Finalizers: []string{managerFinalizer}},
+			Spec: managev1.ClusterAddonSpec{
+				Addons:  []managev1.Addon{{Name: "stack"}},
+				Suspend: true,
+			},
+		}
+		c := newFakeClient(instance)
+		store := NewMemoryStateStore()
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), State: store}
+
+		res, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.RequeueAfter).To(BeZero())
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(instance), instance)).To(Succeed())
+		Expect(instance.Status.StatusCode).To(Equal(managev1.CAddonStatusSuspended))
+		Expect(instance.Status.Addons).To(ConsistOf(managev1.AddonStatus{Name: "stack", Suspended: true}))
+
+		state, err := store.Get(ctx, instance, "stack")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(BeNil())
+	})
+
+	It("holds the finalizer while an addon is suspended", func() {
+		now := metav1.Now()
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "suspended-deleting",
+				Finalizers:        []string{managerFinalizer},
+				DeletionTimestamp: &now,
+			},
+			Spec: managev1.ClusterAddonSpec{
+				Addons: []managev1.Addon{{Name: "stack", Suspended: true}},
+			},
+			Status: managev1.ClusterAddonStatus{StatusCode: managev1.CAddonStatusSuccess},
+		}
+		c := newFakeClient(instance)
+		store := NewMemoryStateStore()
+		Expect(store.Set(ctx, instance, "stack", managev1.AddonState{Version: "v0.1.0"})).To(Succeed())
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), State: store}
+
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(instance), instance)).To(Succeed())
+		Expect(instance.Finalizers).To(ContainElement(managerFinalizer))
+	})
+
+	It("releases the finalizer once a suspended addon is removed from the spec", func() {
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{Name: "unsuspended", Finalizers: []string{managerFinalizer}},
+			Spec: managev1.ClusterAddonSpec{
+				Addons: []managev1.Addon{{Name: "stack", Suspended: true}},
+			},
+		}
+		c := newFakeClient(instance)
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), State: NewMemoryStateStore()}
+
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(instance), instance)).To(Succeed())
+		Expect(instance.Status.Addons).To(ConsistOf(managev1.AddonStatus{Name: "stack", Suspended: true}))
+
+		instance.Spec.Addons = nil
+		instance.Generation++ // The fake client leaves the generation alone
+		Expect(c.Update(ctx, instance)).To(Succeed())
+		_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(instance), instance)).To(Succeed())
+		Expect(instance.Status.Addons).To(BeEmpty())
+
+		Expect(c.Delete(ctx, instance)).To(Succeed())
+		_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		err = c.Get(ctx, client.ObjectKeyFromObject(instance), &managev1.ClusterAddon{})
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("orphans addons whose deletion policy says so", func() {
+		now := metav1.Now()
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "orphaning",
+				Finalizers:        []string{managerFinalizer},
+				DeletionTimestamp: &now,
+			},
+			Spec: managev1.ClusterAddonSpec{
+				Addons: []managev1.Addon{{Name: "stack", DeletionPolicy: managev1.DeletionPolicyOrphan}},
+			},
+			Status: managev1.ClusterAddonStatus{StatusCode: managev1.CAddonStatusSuccess},
+		}
+		c := newFakeClient(instance)
+		store := NewMemoryStateStore()
+		Expect(store.Set(ctx, instance, "stack", managev1.AddonState{Version: "v0.1.0"})).To(Succeed())
+		recorder := record.NewFakeRecorder(10)
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), Recorder: recorder, State: store}
+
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(recorder.Events).To(Receive(HavePrefix("Normal " + EventReasonOrphaned)))
+		state, err := store.Get(ctx, instance, "stack")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(BeNil())
+
+		err = c.Get(ctx, client.ObjectKeyFromObject(instance), &managev1.ClusterAddon{})
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("skips addons which are up to date for the observed generation", func() {
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{Name: "observed", Generation: 3, Finalizers: []string{managerFinalizer}},
+			Spec: managev1.ClusterAddonSpec{
+				Addons: []managev1.Addon{{Name: "stack", Version: ptr.To("v0.1.0")}},
+			},
+		}
+		c := newFakeClient(instance)
+		store := &countingStateStore{StateStore: NewMemoryStateStore()}
+		Expect(store.Set(ctx, instance, "stack", managev1.AddonState{Version: "v0.1.0"})).To(Succeed())
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), State: store}
+
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(instance), instance)).To(Succeed())
+		Expect(instance.Status.StatusCode).To(Equal(managev1.CAddonStatusSuccess))
+		Expect(instance.Status.ObservedGeneration).To(Equal(int64(3)))
+		Expect(store.gets).To(Equal(1))
+
+		_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.gets).To(Equal(1))
+
+		r.drift.setDrifted(instance.Name, "stack")
+		_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.gets).To(Equal(2))
+	})
+
+	It("requeues while a hook Job runs instead of waiting for it", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cfg\n  namespace: ka\n---\n" +
+				"apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: smoke\n  namespace: ka\n  annotations:\n" +
+				"    manage.ksctl.com/hook: post-install\n"))
+		}))
+		defer srv.Close()
+		addonManifests["hooked"] = AddonManifest{URL: func(version string) string { return srv.URL + "/" + version }}
+		defer delete(addonManifests, "hooked")
+
+		core, batch := schema.GroupVersion{Version: "v1"}, schema.GroupVersion{Group: "batch", Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{core, batch})
+		mapper.Add(core.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+		mapper.Add(batch.WithKind("Job"), meta.RESTScopeNamespace)
+		var applies atomic.Int32
+		dc := applyingDynamicClient(&applies)
+
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{Name: "hooked", Finalizers: []string{managerFinalizer}},
+			Spec: managev1.ClusterAddonSpec{
+				Addons: []managev1.Addon{{Name: "hooked", Version: ptr.To("v0.1.0")}},
+			},
+		}
+		c := newFakeClient(instance)
+		store := NewMemoryStateStore()
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), RESTMapper: mapper, DynamicClient: dc, State: store}
+
+		res, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.RequeueAfter).To(Equal(pollInterval))
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(instance), instance)).To(Succeed())
+		Expect(instance.Status.StatusCode).To(Equal(managev1.CAddonStatusPending))
+		Expect(addonStatus(instance, "hooked").Retry).To(BeNil())
+		state, err := store.Get(ctx, instance, "hooked")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(BeNil())
+
+		// The objects are not applied again while the Job is only checked on
+		applied := applies.Load()
+		_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(applies.Load()).To(Equal(applied))
+
+		jobs := dc.Resource(batch.WithResource("jobs")).Namespace("ka")
+		job, err := jobs.Get(ctx, "smoke", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unstructured.SetNestedSlice(job.Object, []interface{}{
+			map[string]interface{}{"type": "Complete", "status": "True"},
+		}, "status", "conditions")).To(Succeed())
+		Expect(jobs.Update(ctx, job, metav1.UpdateOptions{})).Error().NotTo(HaveOccurred())
+
+		_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(instance), instance)).To(Succeed())
+		Expect(instance.Status.StatusCode).To(Equal(managev1.CAddonStatusSuccess))
+		state, err = store.Get(ctx, instance, "hooked")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state.Version).To(Equal("v0.1.0"))
+		Expect(state.Inventory).To(ContainElement(managev1.ObjectReference{
+			APIVersion: "batch/v1", Kind: "Job", Namespace: "ka", Name: "smoke",
+		}))
+	})
+
+	It("records lifecycle events on the ClusterAddon", func() {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+
+		addonManifests["events"] = AddonManifest{
+			URL: func(version string) string { return srv.URL + "/" + version + "/install.yaml" },
+		}
+		defer delete(addonManifests, "events")
+
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{Name: "events", Finalizers: []string{managerFinalizer}},
+			Spec: managev1.ClusterAddonSpec{
+				Addons: []managev1.Addon{{Name: "events", Version: ptr.To("v0.1.0")}},
+			},
+		}
+		c := newFakeClient(instance)
+		recorder := record.NewFakeRecorder(10)
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), Recorder: recorder, State: NewMemoryStateStore()}
+
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(recorder.Events).To(Receive(HavePrefix("Normal " + EventReasonInstallStarted)))
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning " + EventReasonDownloadFailed)))
+
+		Expect(testutil.ToFloat64(addonOperationsTotal.WithLabelValues("events", operationInstall, resultFailure))).To(Equal(1.0))
+	})
+})
+
+// countingStateStore counts the reads of addon state.
+type countingStateStore struct {
+	StateStore
+	gets int
+}
+
+func (s *countingStateStore) Get(ctx context.Context, owner *managev1.ClusterAddon, addonName string) (*managev1.AddonState, error) {
+	s.gets++
+	return s.StateStore.Get(ctx, owner, addonName)
+}
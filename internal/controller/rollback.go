@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+func autoRollback(addon managev1.Addon) bool {
+	return addon.AutoRollback == nil || *addon.AutoRollback
+}
+
+// rolledBack reports whether the upgrade of the addon to version failed and
+// was rolled back for the current generation of the ClusterAddon. Trying it
+// again would only fail and roll back again, until the spec changes.
+func rolledBack(instance *managev1.ClusterAddon, addonName string, state *managev1.AddonState, version string) bool {
+	if state == nil || addonStatus(instance, addonName).FailedVersion != version {
+		return false
+	}
+	n := len(state.History)
+	return n > 0 && state.History[n-1].Version == version &&
+		state.History[n-1].Result == managev1.AddonRevisionRolledBack &&
+		state.History[n-1].Generation == instance.Generation
+}
+
+// rollback re-applies the installed version of an addon after an upgrade to
+// failedVersion failed midway with cause, and removes the objects only the
+// failed version shipped.
+func (r *ClusterAddonReconciler) rollback(
+	ctx context.Context,
+	instance *managev1.ClusterAddon,
+	addon managev1.Addon,
+	manifest AddonManifest,
+	state *managev1.AddonState,
+	failedVersion string,
+	failedObjs []*unstructured.Unstructured,
+	cause error,
+) (err error) {
+	l := log.FromContext(ctx)
+	l.Info("Rolling back addon", "to", state.Version, "reason", cause.Error())
+	r.warning(instance, EventReasonRollbackStarted, "Upgrade of addon %s to %s failed, rolling back to %s: %v",
+		addon.Name, failedVersion, state.Version, cause)
+	addonStatus(instance, addon.Name).FailedVersion = failedVersion
+
+	ctx, span := r.startSpan(ctx, "rollback", attribute.String("addon", addon.Name), attribute.String("version", state.Version))
+	defer func() { endSpan(span, err) }()
+
+	rollbackErr := func() error {
+		objs, err := r.installedManifest(ctx, instance, addon, manifest, state)
+		if err != nil {
+			return err
+		}
+
+		if err := r.applyStaged(ctx, objs, r.applyResource(newConflictResolver(addon)), true); err != nil {
+			return err
+		}
+		return operateResources(ctx, deletionOrder(staleObjects(failedObjs, objs)), r.pruneResource)
+	}()
+	recordOperation(addon.Name, operationRollback, rollbackErr)
+
+	if rollbackErr != nil {
+		r.warning(instance, EventReasonRollbackFailed, "Failed to roll back addon %s to %s: %v", addon.Name, state.Version, rollbackErr)
+		return rollbackErr
+	}
+
+	l.Info("Rolled back addon", "to", state.Version)
+	r.event(instance, EventReasonRolledBack, "Rolled back addon %s to %s", addon.Name, state.Version)
+	return nil
+}
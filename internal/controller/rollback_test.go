@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+// applyingDynamicClient returns a fake dynamic client which creates the
+// objects applied to it, the fake only applies to existing objects. Applying
+// objects named broken fails.
+func applyingDynamicClient(applies *atomic.Int32) *dynamicfake.FakeDynamicClient {
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			{Version: "v1", Resource: "configmaps"}:                 "ConfigMapList",
+			{Version: "v1", Resource: "pods"}:                       "PodList",
+			{Group: "apps", Version: "v1", Resource: "deployments"}: "DeploymentList",
+			{Group: "batch", Version: "v1", Resource: "jobs"}:       "JobList",
+		})
+	dc.PrependReactor("patch", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		patch := action.(clienttesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		applies.Add(1)
+		if patch.GetName() == "broken" {
+			return true, nil, fmt.Errorf("admission webhook denied the request")
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := json.Unmarshal(patch.GetPatch(), &obj.Object); err != nil {
+			return true, nil, err
+		}
+		err := dc.Tracker().Create(patch.GetResource(), obj, patch.GetNamespace())
+		if errors.IsAlreadyExists(err) {
+			err = dc.Tracker().Update(patch.GetResource(), obj, patch.GetNamespace())
+		}
+		return true, obj, err
+	})
+	return dc
+}
+
+var _ = Describe("Rollback", func() {
+	ctx := context.Background()
+
+	It("rolls a failed upgrade back to the applied manifest and does not retry it", func() {
+		// Releases may be re-published, the rollback must not depend on them
+		manifests := map[string]string{
+			"v0.1.0": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cfg\n  namespace: ka\ndata:\n  release: one\n",
+			"v0.2.0": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cfg\n  namespace: ka\ndata:\n  release: two\n" +
+				"---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: broken\n  namespace: ka\n",
+		}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte(manifests[strings.TrimPrefix(req.URL.Path, "/")]))
+		}))
+		defer srv.Close()
+		addonManifests["rollback"] = AddonManifest{URL: func(version string) string { return srv.URL + "/" + version }}
+		defer delete(addonManifests, "rollback")
+
+		gv := schema.GroupVersion{Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+		var applies atomic.Int32
+		dc := applyingDynamicClient(&applies)
+		store := NewMemoryStateStore()
+		r := &ClusterAddonReconciler{Client: newFakeClient(), RESTMapper: mapper, DynamicClient: dc, State: store}
+
+		instance := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "rollback", Generation: 1}}
+		Expect(r.HandleAddon(ctx, instance, managev1.Addon{Name: "rollback", Version: ptr.To("v0.1.0")})).To(Succeed())
+		manifests["v0.1.0"] = ""
+		Expect(r.Get(ctx, client.ObjectKey{Namespace: stateNamespace, Name: manifestSecretName("rollback")}, &corev1.Secret{})).To(Succeed())
+
+		upgrade := managev1.Addon{Name: "rollback", Version: ptr.To("v0.2.0")}
+		Expect(r.HandleAddon(ctx, instance, upgrade)).To(MatchError(ContainSubstring("rolled back to v0.1.0")))
+
+		cfg, err := dc.Resource(gv.WithResource("configmaps")).Namespace("ka").Get(ctx, "cfg", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Object["data"]).To(Equal(map[string]interface{}{"release": "one"}))
+		Expect(addonStatus(instance, "rollback").FailedVersion).To(Equal("v0.2.0"))
+
+		state, err := store.Get(ctx, instance, "rollback")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state.Version).To(Equal("v0.1.0"))
+		Expect(state.History[len(state.History)-1].Result).To(Equal(managev1.AddonRevisionRolledBack))
+
+		// The same spec would only fail again
+		applied := applies.Load()
+		Expect(r.HandleAddon(ctx, instance, upgrade)).To(MatchError(ContainSubstring("retried once the ClusterAddon changes")))
+		Expect(applies.Load()).To(Equal(applied))
+
+		instance.Generation++
+		Expect(r.HandleAddon(ctx, instance, upgrade)).To(MatchError(ContainSubstring("rolled back to v0.1.0")))
+		Expect(applies.Load()).To(BeNumerically(">", applied))
+	})
+
+	It("keeps a rollback done once its target left the history", func() {
+		manifests := map[string]string{
+			"v0.1.0": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cfg\n  namespace: ka\ndata:\n  release: one\n",
+			"v0.2.0": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cfg\n  namespace: ka\ndata:\n  release: two\n",
+		}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte(manifests[strings.TrimPrefix(req.URL.Path, "/")]))
+		}))
+		defer srv.Close()
+		addonManifests["limited"] = AddonManifest{URL: func(version string) string { return srv.URL + "/" + version }}
+		defer delete(addonManifests, "limited")
+
+		gv := schema.GroupVersion{Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+		var applies atomic.Int32
+		store := NewMemoryStateStore()
+		r := &ClusterAddonReconciler{Client: newFakeClient(), RESTMapper: mapper, DynamicClient: applyingDynamicClient(&applies), State: store}
+
+		instance := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "limited", Generation: 1}}
+		addon := managev1.Addon{Name: "limited", Version: ptr.To("v0.1.0"), RevisionHistoryLimit: ptr.To(int32(2))}
+		Expect(r.HandleAddon(ctx, instance, addon)).To(Succeed())
+		addon.Version = ptr.To("v0.2.0")
+		Expect(r.HandleAddon(ctx, instance, addon)).To(Succeed())
+
+		addon.RollbackTo = ptr.To(int64(1))
+		Expect(r.HandleAddon(ctx, instance, addon)).To(Succeed())
+		state, err := store.Get(ctx, instance, "limited")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state.Version).To(Equal("v0.1.0"))
+		Expect(state.History).To(HaveLen(2))
+		Expect(state.History[0].Revision).To(Equal(int64(2)))
+
+		applied := applies.Load()
+		Expect(r.HandleAddon(ctx, instance, addon)).To(Succeed())
+		Expect(applies.Load()).To(Equal(applied))
+	})
+})
@@ -0,0 +1,316 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+const (
+	StateBackendConfigMap = "configmap"
+	StateBackendSecret    = "secret"
+	StateBackendStatus    = "status"
+
+	stateNamespace = "kcm-system"
+	stateName      = "kcm-addons"
+)
+
+// StateStore persists the AddonState kcm keeps for every installed addon.
+// The owner is the ClusterAddon currently being reconciled, backends which
+// keep a cluster wide record are free to ignore it.
+type StateStore interface {
+	// Get returns the recorded state of the addon, or nil if it is not installed.
+	Get(ctx context.Context, owner *managev1.ClusterAddon, addonName string) (*managev1.AddonState, error)
+	// Set records the state of the addon, replacing any previous record.
+	Set(ctx context.Context, owner *managev1.ClusterAddon, addonName string, state managev1.AddonState) error
+	// Delete forgets the addon, it is not an error if it was never recorded.
+	Delete(ctx context.Context, owner *managev1.ClusterAddon, addonName string) error
+}
+
+// NewStateStore returns the StateStore for the given backend name.
+func NewStateStore(backend string, c client.Client) (StateStore, error) {
+	switch backend {
+	case StateBackendConfigMap:
+		return NewConfigMapStateStore(c), nil
+	case StateBackendSecret:
+		return NewSecretStateStore(c), nil
+	case StateBackendStatus:
+		return &StatusStateStore{Client: c}, nil
+	default:
+		return nil, fmt.Errorf("unsupported state backend: %s", backend)
+	}
+}
+
+func decodeAddonState(raw []byte) (*managev1.AddonState, error) {
+	state := &managev1.AddonState{}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, fmt.Errorf("failed to decode addon state: %w", err)
+	}
+	return state, nil
+}
+
+// ConfigMapStateStore keeps the state of all addons as JSON documents in a
+// single ConfigMap, keyed by addon name.
+type ConfigMapStateStore struct {
+	Client    client.Client
+	Namespace string
+	Name      string
+
+	// mu serializes the updates of concurrent reconciles, which share the
+	// object
+	mu sync.Mutex
+}
+
+func NewConfigMapStateStore(c client.Client) *ConfigMapStateStore {
+	return &ConfigMapStateStore{Client: c, Namespace: stateNamespace, Name: stateName}
+}
+
+func (s *ConfigMapStateStore) Get(ctx context.Context, _ *managev1.ClusterAddon, addonName string) (*managev1.AddonState, error) {
+	cf := &corev1.ConfigMap{}
+	if err := s.Client.Get(ctx, client.ObjectKey{Namespace: s.Namespace, Name: s.Name}, cf); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	v, ok := cf.Data[addonName]
+	if !ok {
+		return nil, nil
+	}
+	return decodeAddonState([]byte(v))
+}
+
+func (s *ConfigMapStateStore) Set(ctx context.Context, _ *managev1.ClusterAddon, addonName string, state managev1.AddonState) error {
+	v, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.update(ctx, func(data map[string]string) {
+		data[addonName] = string(v)
+	})
+}
+
+func (s *ConfigMapStateStore) Delete(ctx context.Context, _ *managev1.ClusterAddon, addonName string) error {
+	return s.update(ctx, func(data map[string]string) {
+		delete(data, addonName)
+	})
+}
+
+func (s *ConfigMapStateStore) update(ctx context.Context, mutate func(data map[string]string)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return updateData(ctx, s.Client, client.ObjectKey{Namespace: s.Namespace, Name: s.Name},
+		func() client.Object { return &corev1.ConfigMap{} },
+		func(obj client.Object) *map[string]string { return &obj.(*corev1.ConfigMap).Data },
+		mutate)
+}
+
+// SecretStateStore is the ConfigMapStateStore counterpart for clusters where
+// the addon bookkeeping should not be readable by everyone who can list
+// ConfigMaps.
+type SecretStateStore struct {
+	Client    client.Client
+	Namespace string
+	Name      string
+
+	// mu serializes the updates of concurrent reconciles, which share the
+	// object
+	mu sync.Mutex
+}
+
+func NewSecretStateStore(c client.Client) *SecretStateStore {
+	return &SecretStateStore{Client: c, Namespace: stateNamespace, Name: stateName}
+}
+
+func (s *SecretStateStore) Get(ctx context.Context, _ *managev1.ClusterAddon, addonName string) (*managev1.AddonState, error) {
+	sec := &corev1.Secret{}
+	if err := s.Client.Get(ctx, client.ObjectKey{Namespace: s.Namespace, Name: s.Name}, sec); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	v, ok := sec.Data[addonName]
+	if !ok {
+		return nil, nil
+	}
+	return decodeAddonState(v)
+}
+
+func (s *SecretStateStore) Set(ctx context.Context, _ *managev1.ClusterAddon, addonName string, state managev1.AddonState) error {
+	v, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.update(ctx, func(data map[string][]byte) {
+		data[addonName] = v
+	})
+}
+
+func (s *SecretStateStore) Delete(ctx context.Context, _ *managev1.ClusterAddon, addonName string) error {
+	return s.update(ctx, func(data map[string][]byte) {
+		delete(data, addonName)
+	})
+}
+
+func (s *SecretStateStore) update(ctx context.Context, mutate func(data map[string][]byte)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return updateData(ctx, s.Client, client.ObjectKey{Namespace: s.Namespace, Name: s.Name},
+		func() client.Object { return &corev1.Secret{Type: corev1.SecretTypeOpaque} },
+		func(obj client.Object) *map[string][]byte { return &obj.(*corev1.Secret).Data },
+		mutate)
+}
+
+// updateData applies mutate to the data of the object at key, which data
+// returns of an object made by newObject, creating the object if it does
+// not exist yet.
+func updateData[V any](
+	ctx context.Context,
+	c client.Client,
+	key client.ObjectKey,
+	newObject func() client.Object,
+	data func(obj client.Object) *map[string]V,
+	mutate func(data map[string]V),
+) error {
+	// The cached client may not have seen the previous update yet, give it
+	// time to catch up
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		obj := newObject()
+		err := c.Get(ctx, key, obj)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		exists := err == nil
+		if !exists {
+			obj = newObject()
+			obj.SetName(key.Name)
+			obj.SetNamespace(key.Namespace)
+		}
+
+		d := data(obj)
+		if *d == nil {
+			*d = map[string]V{}
+		}
+		mutate(*d)
+		if !exists {
+			return c.Create(ctx, obj)
+		}
+		return c.Update(ctx, obj)
+	})
+}
+
+// StatusStateStore keeps the state of each addon in the status of the
+// ClusterAddon which installed it, so the bookkeeping lives and dies with
+// the owning object.
+type StatusStateStore struct {
+	Client client.Client
+}
+
+func (s *StatusStateStore) Get(_ context.Context, owner *managev1.ClusterAddon, addonName string) (*managev1.AddonState, error) {
+	for _, a := range owner.Status.Addons {
+		if a.Name == addonName && a.State != nil {
+			state := *a.State
+			return &state, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *StatusStateStore) Set(ctx context.Context, owner *managev1.ClusterAddon, addonName string, state managev1.AddonState) error {
+	return s.update(ctx, owner, func() {
+		addonStatus(owner, addonName).State = &state
+	})
+}
+
+func (s *StatusStateStore) Delete(ctx context.Context, owner *managev1.ClusterAddon, addonName string) error {
+	return s.update(ctx, owner, func() {
+		for i := range owner.Status.Addons {
+			if owner.Status.Addons[i].Name == addonName {
+				owner.Status.Addons[i].State = nil
+			}
+		}
+	})
+}
+
+// update writes the status of owner with mutate applied. The status is only
+// written by the reconcile of owner, which holds the newest one in memory:
+// on conflicts only the resourceVersion is refreshed, the status kept.
+func (s *StatusStateStore) update(ctx context.Context, owner *managev1.ClusterAddon, mutate func()) error {
+	first := true
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if !first {
+			latest := &managev1.ClusterAddon{}
+			if err := s.Client.Get(ctx, client.ObjectKeyFromObject(owner), latest); err != nil {
+				return err
+			}
+			owner.ResourceVersion = latest.ResourceVersion
+		}
+		first = false
+
+		mutate()
+		return s.Client.Status().Update(ctx, owner)
+	})
+}
+
+// lockAddon serializes the operations on an addon. Its state is shared by
+// every ClusterAddon listing it, so reading the state, installing or
+// uninstalling and recording the outcome must not interleave between
+// concurrent reconciles.
+func (r *ClusterAddonReconciler) lockAddon(addonName string) (unlock func()) {
+	mu, _ := r.addonLocks.LoadOrStore(addonName, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// MemoryStateStore keeps addon state in memory, it is meant for unit tests
+// which exercise the reconciler without a cluster.
+type MemoryStateStore struct {
+	mu     sync.Mutex
+	states map[string]managev1.AddonState
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{states: map[string]managev1.AddonState{}}
+}
+
+func (s *MemoryStateStore) Get(_ context.Context, _ *managev1.ClusterAddon, addonName string) (*managev1.AddonState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[addonName]
+	if !ok {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (s *MemoryStateStore) Set(_ context.Context, _ *managev1.ClusterAddon, addonName string, state managev1.AddonState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states[addonName] = state
+	return nil
+}
+
+func (s *MemoryStateStore) Delete(_ context.Context, _ *managev1.ClusterAddon, addonName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.states, addonName)
+	return nil
+}
@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+func newFakeClient(objs ...client.Object) client.Client {
+	s := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(s))
+	utilruntime.Must(managev1.AddToScheme(s))
+
+	return fake.NewClientBuilder().
+		WithScheme(s).
+		WithObjects(objs...).
+		WithStatusSubresource(&managev1.ClusterAddon{}).
+		Build()
+}
+
+var _ = Describe("StateStore", func() {
+	ctx := context.Background()
+
+	DescribeTable("records, returns and forgets addon state",
+		func(newStore func(c client.Client) StateStore) {
+			owner := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "owner"}}
+			c := newFakeClient(owner)
+			store := newStore(c)
+
+			state, err := store.Get(ctx, owner, "stack")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state).To(BeNil())
+
+			Expect(store.Set(ctx, owner, "stack", managev1.AddonState{Version: "v0.1.0"})).To(Succeed())
+			Expect(store.Set(ctx, owner, "other", managev1.AddonState{Version: "v1.0.0"})).To(Succeed())
+
+			state, err = store.Get(ctx, owner, "stack")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state).NotTo(BeNil())
+			Expect(state.Version).To(Equal("v0.1.0"))
+
+			Expect(store.Delete(ctx, owner, "stack")).To(Succeed())
+			Expect(store.Delete(ctx, owner, "missing")).To(Succeed())
+
+			state, err = store.Get(ctx, owner, "stack")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state).To(BeNil())
+
+			state, err = store.Get(ctx, owner, "other")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.Version).To(Equal("v1.0.0"))
+		},
+		Entry("configmap", func(c client.Client) StateStore { return NewConfigMapStateStore(c) }),
+		Entry("secret", func(c client.Client) StateStore { return NewSecretStateStore(c) }),
+		Entry("status", func(c client.Client) StateStore { return &StatusStateStore{Client: c} }),
+		Entry("memory", func(client.Client) StateStore { return NewMemoryStateStore() }),
+	)
+
+	DescribeTable("keeps the updates of concurrent reconciles",
+		func(newStore func(c client.Client) StateStore) {
+			owner := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "owner"}}
+			store := newStore(newFakeClient(owner))
+
+			var wg sync.WaitGroup
+			for i := range 10 {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					Expect(store.Set(ctx, owner, fmt.Sprintf("addon-%d", i), managev1.AddonState{Version: "v0.1.0"})).To(Succeed())
+				}()
+			}
+			wg.Wait()
+
+			for i := range 10 {
+				state, err := store.Get(ctx, owner, fmt.Sprintf("addon-%d", i))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(state).NotTo(BeNil())
+			}
+		},
+		Entry("configmap", func(c client.Client) StateStore { return NewConfigMapStateStore(c) }),
+		Entry("secret", func(c client.Client) StateStore { return NewSecretStateStore(c) }),
+	)
+
+	It("keeps the status of the reconcile when recording state conflicts", func() {
+		owner := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: "owner"}}
+		c := newFakeClient(owner)
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(owner), owner)).To(Succeed())
+
+		// Someone else bumps the resourceVersion meanwhile
+		stale := owner.DeepCopy()
+		Expect(c.Status().Update(ctx, owner)).To(Succeed())
+
+		stale.Status.ReasonOfFailure = "from the reconcile"
+		store := &StatusStateStore{Client: c}
+		Expect(store.Set(ctx, stale, "stack", managev1.AddonState{Version: "v0.1.0"})).To(Succeed())
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(owner), owner)).To(Succeed())
+		Expect(owner.Status.ReasonOfFailure).To(Equal("from the reconcile"))
+		Expect(addonStatus(owner, "stack").State).To(Equal(&managev1.AddonState{Version: "v0.1.0"}))
+	})
+
+	It("shares the default store between reconciles", func() {
+		r := &ClusterAddonReconciler{Client: newFakeClient()}
+		Expect(r.stateStore()).To(BeIdenticalTo(r.stateStore()))
+	})
+
+	It("installs an addon listed by two ClusterAddons once", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cfg\n  namespace: ka\n"))
+		}))
+		defer srv.Close()
+		addonManifests["shared"] = AddonManifest{URL: func(string) string { return srv.URL }}
+		defer delete(addonManifests, "shared")
+
+		gv := schema.GroupVersion{Version: "v1"}
+		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+		mapper.Add(gv.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+		var applies atomic.Int32
+		r := &ClusterAddonReconciler{
+			Client:        newFakeClient(),
+			RESTMapper:    mapper,
+			DynamicClient: applyingDynamicClient(&applies),
+			State:         slowStateStore{NewMemoryStateStore()},
+		}
+
+		addon := managev1.Addon{Name: "shared", Version: ptr.To("v0.1.0")}
+		var wg sync.WaitGroup
+		for _, name := range []string{"platform", "team"} {
+			owner := &managev1.ClusterAddon{ObjectMeta: metav1.ObjectMeta{Name: name, Generation: 1}}
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(r.HandleAddon(ctx, owner, addon)).To(Succeed())
+			}()
+		}
+		wg.Wait()
+		Expect(applies.Load()).To(Equal(int32(1)))
+	})
+
+	It("rejects unknown backends", func() {
+		_, err := NewStateStore("etcd", newFakeClient())
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+// slowStateStore widens the window between reading the state of an addon and
+// recording it.
+type slowStateStore struct {
+	StateStore
+}
+
+func (s slowStateStore) Get(ctx context.Context, owner *managev1.ClusterAddon, addonName string) (*managev1.AddonState, error) {
+	time.Sleep(50 * time.Millisecond)
+	return s.StateStore.Get(ctx, owner, addonName)
+}
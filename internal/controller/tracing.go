@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const tracerName = "github.com/ksctl/kcm/internal/controller"
+
+func (r *ClusterAddonReconciler) tracer() trace.Tracer {
+	if r.TracerProvider == nil {
+		return otel.GetTracerProvider().Tracer(tracerName)
+	}
+	return r.TracerProvider.Tracer(tracerName)
+}
+
+// startSpan starts a span which must be closed with endSpan.
+func (r *ClusterAddonReconciler) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return r.tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func objectAttributes(obj *unstructured.Unstructured) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("k8s.gvk", obj.GroupVersionKind().String()),
+		attribute.String("k8s.namespace", obj.GetNamespace()),
+		attribute.String("k8s.name", obj.GetName()),
+	}
+}
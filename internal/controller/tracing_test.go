@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	managev1 "github.com/ksctl/kcm/api/v1"
+)
+
+var _ = Describe("Tracing", func() {
+	ctx := context.Background()
+
+	It("traces the reconcile and its status updates", func() {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+		instance := &managev1.ClusterAddon{
+			ObjectMeta: metav1.ObjectMeta{Name: "traced", Finalizers: []string{managerFinalizer}},
+			Spec: managev1.ClusterAddonSpec{
+				Addons: []managev1.Addon{{Name: "does-not-exist"}},
+			},
+		}
+		c := newFakeClient(instance)
+		r := &ClusterAddonReconciler{Client: c, Scheme: c.Scheme(), State: NewMemoryStateStore(), TracerProvider: tp}
+
+		// Failing addons are retried with their backoff, not reported as reconcile errors
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		Expect(err).NotTo(HaveOccurred())
+
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, s := range recorder.Ended() {
+			spans[s.Name()] = s
+		}
+		Expect(spans).To(HaveKey("Reconcile"))
+		Expect(spans).To(HaveKey("updateStatus"))
+
+		root := spans["Reconcile"]
+		Expect(root.Status().Code).NotTo(Equal(codes.Error))
+		Expect(spans["updateStatus"].Parent().SpanID()).To(Equal(root.SpanContext().SpanID()))
+	})
+})